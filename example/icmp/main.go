@@ -18,17 +18,17 @@ func main() {
 	}
 	log.SetOutput(file)
 
-	err = pkg.NetInit(true)
+	s, err := pkg.NetInit(true)
 	if err != nil {
 		fmt.Println(err.Error())
 		return
 	}
 
-	pkg.NetRun()
+	s.Run()
 	time.Sleep(10 * time.Second)
 	/*
 		In this section, you can ping to 192.0.2.2
 	*/
-	pkg.NetShutdown()
+	s.Shutdown()
 
 }
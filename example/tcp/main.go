@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"time"
 
@@ -23,7 +24,7 @@ func main() {
 	}
 	log.SetOutput(file)
 
-	err = pkg.NetInit(true)
+	s, err := pkg.NetInit(true)
 	if err != nil {
 		log.Println(err.Error())
 		return
@@ -31,8 +32,8 @@ func main() {
 
 	src, _ := tcp.Str2Endpoint(srcAddr)
 
-	pkg.NetRun()
-	soc, err := tcp.Newpcb(src)
+	s.Run()
+	ln, err := s.TCP.Listen(src)
 	if err != nil {
 		log.Println(err.Error())
 		return
@@ -45,78 +46,50 @@ func main() {
 		At first, command "go run main.go&" and start the server in background.
 		This server runs in 30s, if you command "nc -nv 192.0.2.2 8080" an
 		, you can see the text you sent will be returned.
+		Several clients can connect to the server at the same time.
 
 	*/
 	clock := time.After(30 * time.Second)
 
-	// for open
-	errOpen := make(chan error)
-	go soc.Open(errOpen, tcp.Endpoint{}, false, 5*time.Minute)
-
-	// for receive
-	errRcv := make(chan error)
-	buf := make([]byte, 100)
-	var n, rcv int
-
-	// for send
-	errSnd := make(chan error)
-
-	func() {
+	go func() {
 		for {
-			if rcv == 0 && soc.Status() == tcp.PCBStateEstablished {
-				go soc.Receive(errRcv, buf, &n)
-				rcv++
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Println(err.Error())
+				return
 			}
-
-			select {
-			case err = <-errOpen:
-				if err != nil {
-					log.Println(err.Error())
-					return
-				} else {
-					log.Println("open succeeded")
-				}
-			case err = <-errRcv:
-				if err != nil {
-					log.Println(err.Error())
-					return
-				} else {
+			log.Printf("accepted: %s", conn.RemoteAddr())
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 100)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						log.Println(err.Error())
+						return
+					}
 					log.Printf("received: %s", string(buf[:n]))
-					rcv--
-					go soc.Send(errSnd, buf[:n])
-				}
-			case err = <-errSnd:
-				if err != nil {
-					log.Println(err.Error())
-					return
-				} else {
+					if _, err = conn.Write(buf[:n]); err != nil {
+						log.Println(err.Error())
+						return
+					}
 					log.Println("send succeeded")
 				}
-			case <-clock:
-				return
-			default:
-				time.Sleep(time.Millisecond)
-			}
+			}(conn)
 		}
 	}()
+	<-clock
 
 	// close
-	errClose := make(chan error)
-	go soc.Close(errClose)
-	err = <-errClose
+	err = ln.Close()
 	if err != nil {
 		log.Println(err.Error())
-		return
 	} else {
 		log.Println("close succeeded")
 	}
 
-	err = tcp.Deletepcb(soc)
-	if err != nil {
-		log.Println(err.Error())
-	}
-
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		log.Println(err.Error())
 	}
@@ -23,7 +23,7 @@ func main() {
 	}
 	log.SetOutput(file)
 
-	err = pkg.NetInit(true)
+	s, err := pkg.NetInit(true)
 	if err != nil {
 		log.Println(err.Error())
 		return
@@ -31,8 +31,8 @@ func main() {
 
 	src, _ := udp.Str2Endpoint(srcAddr)
 
-	pkg.NetRun()
-	soc := udp.Open()
+	s.Run()
+	soc := s.UDP.Open()
 	err = soc.Bind(src)
 	if err != nil {
 		log.Println(err.Error())
@@ -69,12 +69,12 @@ func main() {
 		}
 	}()
 
-	err = udp.Close(soc)
+	err = s.UDP.Close(soc)
 	if err != nil {
 		log.Println(err.Error())
 	}
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		log.Println(err.Error())
 	}
@@ -3,7 +3,6 @@ package arp
 import (
 	"fmt"
 	"log"
-	"sync"
 	"time"
 
 	"github.com/hedwig100/go-network/pkg/device"
@@ -20,11 +19,6 @@ const (
 	cacheStatic     uint8 = 3
 )
 
-var (
-	mutex  sync.Mutex
-	caches [cacheSize]cacheEntry
-)
-
 // cacheEntry is arp cache table's entry
 type cacheEntry struct {
 
@@ -43,12 +37,12 @@ type cacheEntry struct {
 
 // cacheAlloc searches empty cache entry in the cache table and returns the index,
 // if no empty entry is found, index of the oldest entry is returned.
-func cacheAlloc() int {
+func (p *Proto) cacheAlloc() int {
 
 	var id int
 	var oldest cacheEntry
 
-	for i, cache := range caches {
+	for i, cache := range p.caches {
 
 		// empty cache
 		if cache.state == cacheFree {
@@ -66,11 +60,11 @@ func cacheAlloc() int {
 }
 
 // cacheInsert inserts cache entry to the cache table
-func cacheInsert(pa ip.Addr, ha device.EtherAddr) {
+func (p *Proto) cacheInsert(pa ip.Addr, ha device.EtherAddr) {
 
-	id := cacheAlloc()
+	id := p.cacheAlloc()
 	timeval := time.Now()
-	caches[id] = cacheEntry{
+	p.caches[id] = cacheEntry{
 		state:   cacheResolved,
 		pa:      pa,
 		ha:      ha,
@@ -82,9 +76,9 @@ func cacheInsert(pa ip.Addr, ha device.EtherAddr) {
 
 // cacheSelect selects cache entry from the cache table
 // and returns index of the entry
-func cacheSelect(pa ip.Addr) (int, error) {
+func (p *Proto) cacheSelect(pa ip.Addr) (int, error) {
 
-	for i, cache := range caches {
+	for i, cache := range p.caches {
 		if cache.state != cacheFree && cache.pa == pa {
 			return i, nil
 		}
@@ -96,17 +90,17 @@ func cacheSelect(pa ip.Addr) (int, error) {
 // cacheUpdate updates cache entry in the cache table
 // return true if cache was inserted before and update is successful
 // return false if cache was not there and update is unsuccessful
-func cacheUpdate(pa ip.Addr, ha device.EtherAddr) bool {
+func (p *Proto) cacheUpdate(pa ip.Addr, ha device.EtherAddr) bool {
 
 	// get cache index
-	id, err := cacheSelect(pa)
+	id, err := p.cacheSelect(pa)
 	if err != nil {
 		return false
 	}
 
 	// update
 	timeval := time.Now()
-	caches[id] = cacheEntry{
+	p.caches[id] = cacheEntry{
 		state:   cacheResolved,
 		pa:      pa,
 		ha:      ha,
@@ -117,13 +111,13 @@ func cacheUpdate(pa ip.Addr, ha device.EtherAddr) bool {
 }
 
 // cacheDelete deletes cache entry from the cache table
-func cacheDelete(id int) error {
+func (p *Proto) cacheDelete(id int) error {
 	if id < 0 || id >= int(cacheSize) {
 		return fmt.Errorf("cache table index out of range")
 	}
 
-	log.Printf("[D] ARP cache delete ps=%s,ha=%s", caches[id].pa, caches[id].ha)
-	caches[id] = cacheEntry{
+	log.Printf("[D] ARP cache delete ps=%s,ha=%s", p.caches[id].pa, p.caches[id].ha)
+	p.caches[id] = cacheEntry{
 		state: cacheFree,
 	}
 	return nil
@@ -3,6 +3,7 @@ package arp
 import (
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/hedwig100/go-network/pkg/device"
@@ -21,18 +22,23 @@ const (
 	arpOpReply   uint16 = 2
 )
 
-// Init prepare the ARP protocol.
-func Init(done chan struct{}) error {
-	go timer(done)
-	err := net.ProtoRegister(&Proto{})
+// Init prepare the ARP protocol and registers it to the stack.
+func Init(stack *net.Net, done chan struct{}) (*Proto, error) {
+	p := &Proto{}
+	err := stack.ProtoRegister(p)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	go p.timer(done)
+	return p, nil
 }
 
 // Proto implements net.Protocol interface.
-type Proto struct{}
+// Proto has the arp cache table of the stack.
+type Proto struct {
+	mutex  sync.Mutex
+	caches [cacheSize]cacheEntry
+}
 
 func (p *Proto) Type() net.ProtoType {
 	return net.ProtoTypeArp
@@ -43,40 +49,40 @@ func (p *Proto) RxHandler(ch chan net.ProtoBuffer, done chan struct{}) {
 
 	for {
 
-		// check if finished or not
+		// receive data from device unless finished
 		select {
 		case <-done:
 			return
-		default:
+		case pb = <-ch:
 		}
 
-		// receive data from device and transform it to header
-		pb = <-ch
+		// transform data to header
 		hdr, err := data2header(pb.Data)
 		if err != nil {
 			log.Printf("[E] ARP rxHandler: %s", err.Error())
+			continue
 		}
 
 		// update arp cache table
-		mutex.Lock()
-		merge := cacheUpdate(hdr.Spa, hdr.Sha)
-		mutex.Unlock()
+		p.mutex.Lock()
+		merge := p.cacheUpdate(hdr.Spa, hdr.Sha)
+		p.mutex.Unlock()
 
 		// search the IP interface of the device
 		iface, err := net.GetIface(pb.Dev, net.IfaceFamilyIP)
 		if err != nil {
-			return // the data is to other host
+			continue // the data is to other host
 		}
 		ipIface := iface.(*ip.Iface)
 		if ipIface == nil || ipIface.Unicast != hdr.Tpa {
-			return // the data is to other host
+			continue // the data is to other host
 		}
 
 		// insert cache entry if entry is not updated before
 		if !merge {
-			mutex.Lock()
-			cacheInsert(hdr.Spa, hdr.Sha)
-			mutex.Unlock()
+			p.mutex.Lock()
+			p.cacheInsert(hdr.Spa, hdr.Sha)
+			p.mutex.Unlock()
 		}
 
 		log.Printf("[D] ARP rxHandler: dev=%s,arp header=%s", pb.Dev.Name(), hdr)
@@ -93,8 +99,9 @@ func (p *Proto) RxHandler(ch chan net.ProtoBuffer, done chan struct{}) {
 // Reply transmits ARP reply data to dst
 func Reply(ipIface *ip.Iface, tha device.EtherAddr, tpa ip.Addr, dst device.EtherAddr) error {
 
-	dev, ok := ipIface.Dev().(*device.Ether)
-	if !ok {
+	dev := ipIface.Dev()
+	addr, ok := dev.Addr().(device.EtherAddr)
+	if dev.Type() != net.DeviceTypeEther || !ok {
 		return fmt.Errorf("arp only supports EthernetDevice")
 	}
 
@@ -107,7 +114,7 @@ func Reply(ipIface *ip.Iface, tha device.EtherAddr, tpa ip.Addr, dst device.Ethe
 			Pln: ip.AddrLen,
 			Op:  arpOpReply,
 		},
-		Sha: dev.EtherAddr,
+		Sha: addr,
 		Spa: ipIface.Unicast,
 		Tha: tha,
 		Tpa: tpa,
@@ -123,7 +130,7 @@ func Reply(ipIface *ip.Iface, tha device.EtherAddr, tpa ip.Addr, dst device.Ethe
 }
 
 // Resolve receives protocol address and returns hardware address
-func Resolve(iface net.Interface, pa ip.Addr) (net.HardwareAddr, error) {
+func (p *Proto) Resolve(iface net.Interface, pa ip.Addr) (net.HardwareAddr, error) {
 
 	// only supports IPv4 and Ethernet protocol
 	ipIface, ok := iface.(*ip.Iface)
@@ -135,15 +142,15 @@ func Resolve(iface net.Interface, pa ip.Addr) (net.HardwareAddr, error) {
 	}
 
 	// search cache table
-	mutex.Lock()
-	defer mutex.Unlock()
-	index, err := cacheSelect(pa)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	index, err := p.cacheSelect(pa)
 
 	// cache not found
 	if err != nil {
 
-		index = cacheAlloc()
-		caches[index] = cacheEntry{
+		index = p.cacheAlloc()
+		p.caches[index] = cacheEntry{
 			state:   cacheImcomplete,
 			pa:      pa,
 			timeval: time.Now(),
@@ -155,7 +162,7 @@ func Resolve(iface net.Interface, pa ip.Addr) (net.HardwareAddr, error) {
 	}
 
 	// cache found but imcomplete request
-	if caches[index].state == cacheImcomplete {
+	if p.caches[index].state == cacheImcomplete {
 
 		// if found cache is imcomplete,it might be a packet loss,so transmit arp request
 		Request(ipIface, pa)
@@ -163,15 +170,16 @@ func Resolve(iface net.Interface, pa ip.Addr) (net.HardwareAddr, error) {
 	}
 
 	// cache found and get hardware address
-	ha := caches[index].ha
+	ha := p.caches[index].ha
 	return ha, nil
 }
 
 // Request receives interface and target IP address and transmits ARP request to the host(tpa)
 func Request(ipIface *ip.Iface, tpa ip.Addr) error {
 
-	dev, ok := ipIface.Dev().(*device.Ether)
-	if !ok {
+	dev := ipIface.Dev()
+	addr, ok := dev.Addr().(device.EtherAddr)
+	if dev.Type() != net.DeviceTypeEther || !ok {
 		return fmt.Errorf("arp only supports EthernetDevice")
 	}
 
@@ -184,7 +192,7 @@ func Request(ipIface *ip.Iface, tpa ip.Addr) error {
 			Pln: ip.AddrLen,
 			Op:  arpOpRequest,
 		},
-		Sha: dev.EtherAddr,
+		Sha: addr,
 		Spa: ipIface.Unicast,
 		Tha: device.EtherAddrAny,
 		Tpa: tpa,
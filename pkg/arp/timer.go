@@ -5,7 +5,7 @@ import "time"
 const cacheTimeout time.Duration = 30 * time.Second
 
 // timer
-func timer(done chan struct{}) {
+func (p *Proto) timer(done chan struct{}) {
 	for {
 
 		// check if process finishes or not
@@ -16,11 +16,13 @@ func timer(done chan struct{}) {
 		}
 
 		now := time.Now()
-		for i, cache := range caches {
+		p.mutex.Lock()
+		for i, cache := range p.caches {
 			if cache.state != cacheFree && cache.timeval.Add(cacheTimeout).Before(now) {
-				cacheDelete(i) // no error
+				p.cacheDelete(i) // no error
 			}
 		}
+		p.mutex.Unlock()
 
 		// sleep for a second
 		time.Sleep(time.Second)
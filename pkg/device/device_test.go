@@ -12,13 +12,13 @@ import (
 func TestNull(t *testing.T) {
 	var err error
 
-	dev := device.NullInit("null0")
-
-	err = pkg.NetInit(false)
+	s, err := pkg.NetInit(false)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
+	dev := device.NullInit(s.Net, "null0")
+
 	for i := 0; i < 5; i++ {
 		time.Sleep(time.Millisecond)
 		err = net.DeviceOutput(dev, []byte{0xff, 0xff, 0x11}, 0x0000, device.EtherAddrBroadcast)
@@ -27,7 +27,7 @@ func TestNull(t *testing.T) {
 		}
 	}
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
@@ -36,13 +36,13 @@ func TestNull(t *testing.T) {
 func TestLoopback(t *testing.T) {
 	var err error
 
-	dev := device.LoopbackInit("loopback0")
-
-	err = pkg.NetInit(false)
+	s, err := pkg.NetInit(false)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
+	dev := device.LoopbackInit(s.Net, "loopback0")
+
 	for i := 0; i < 5; i++ {
 		time.Sleep(time.Millisecond)
 		err = net.DeviceOutput(dev, []byte{0xff, 0xff, 0x11}, 0x0000, device.EtherAddrBroadcast)
@@ -51,7 +51,7 @@ func TestLoopback(t *testing.T) {
 		}
 	}
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
@@ -60,12 +60,12 @@ func TestLoopback(t *testing.T) {
 func TestEther(t *testing.T) {
 	var err error
 
-	dev, err := device.EtherInit("tap0")
+	s, err := pkg.NetInit(false)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	err = pkg.NetInit(false)
+	dev, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Error(err)
 	}
@@ -78,8 +78,37 @@ func TestEther(t *testing.T) {
 		}
 	}
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestPipe(t *testing.T) {
+	var err error
+
+	// both ends are not registered to any stack
+	dev0, dev1, err := device.PipeInit(nil, "pipe0", nil, "pipe1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		data := []byte{0xff, 0xff, byte(i)}
+		err = net.DeviceOutput(dev0, data, net.ProtoTypeIP, dev1.EtherAddr)
+		if err != nil {
+			t.Error(err)
+		}
+
+		hdr, payload, err := dev1.Recv(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Src != dev0.EtherAddr || hdr.Dst != dev1.EtherAddr || hdr.Type != net.ProtoTypeIP {
+			t.Errorf("unexpected header %s", hdr)
+		}
+		if string(payload) != string(data) {
+			t.Errorf("payload = %v, want %v", payload, data)
+		}
+	}
+}
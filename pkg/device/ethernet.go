@@ -29,8 +29,8 @@ var (
 	EtherAddrBroadcast = EtherAddr([EtherAddrLen]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
 )
 
-// EtherInit setup ethernet device
-func EtherInit(name string) (*Ether, error) {
+// EtherInit setup ethernet device and registers it to the stack
+func EtherInit(stack *net.Net, name string) (*Ether, error) {
 
 	// open tap
 	name, file, err := raw.OpenTap(name)
@@ -53,8 +53,9 @@ func EtherInit(name string) (*Ether, error) {
 		flags:     net.DeviceFlagBroadcast | net.DeviceFlagNeedARP | net.DeviceFlagUp,
 		EtherAddr: EtherAddr(addr),
 		file:      file,
+		stack:     stack,
 	}
-	net.DeviceRegister(e)
+	stack.DeviceRegister(e)
 	return e, nil
 }
 
@@ -133,6 +134,9 @@ type Ether struct {
 
 	// device file (character file)
 	file io.ReadWriteCloser
+
+	// stack to which the device belongs
+	stack *net.Net
 }
 
 func (e *Ether) Name() string {
@@ -247,7 +251,7 @@ func (e *Ether) RxHandler(done chan struct{}) {
 
 			// pass the header and subsequent parts as data to the protocol
 			log.Printf("[D] Ether rxHandler: dev=%s,protocolType=%s,len=%d,header=%s", e.name, hdr.Type, len, hdr)
-			net.DeviceInputHanlder(hdr.Type, payload[:len-EtherHeaderSize], e)
+			e.stack.DeviceInputHanlder(hdr.Type, payload[:len-EtherHeaderSize], e)
 		}
 
 	}
@@ -12,15 +12,17 @@ import (
 type Loopback struct {
 	name  string
 	flags uint16
+	stack *net.Net
 }
 
-// LoopbackInit reveices device name and returns loopback device.
-func LoopbackInit(name string) *Loopback {
+// LoopbackInit reveices device name and returns loopback device registered to the stack.
+func LoopbackInit(stack *net.Net, name string) *Loopback {
 	l := &Loopback{
 		name:  name,
 		flags: net.DeviceFlagUp | net.DeviceFlagLoopback,
+		stack: stack,
 	}
-	net.DeviceRegister(l)
+	stack.DeviceRegister(l)
 	return l
 }
 
@@ -58,7 +60,7 @@ func (l *Loopback) Close() error {
 func (l *Loopback) TxHandler(data []byte, typ net.ProtoType, dst net.HardwareAddr) error {
 
 	// send back
-	net.DeviceInputHanlder(typ, data, l)
+	l.stack.DeviceInputHanlder(typ, data, l)
 
 	log.Printf("[I] Loopback TxHandler: data(%v) is trasmitted by loopback-device(name=%s)", data, l.name)
 	return nil
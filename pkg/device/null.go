@@ -13,12 +13,12 @@ type Null struct {
 	flags uint16
 }
 
-func NullInit(name string) *Null {
+func NullInit(stack *net.Net, name string) *Null {
 	n := &Null{
 		name:  name,
 		flags: net.DeviceFlagUp,
 	}
-	net.DeviceRegister(n)
+	stack.DeviceRegister(n)
 	return n
 }
 
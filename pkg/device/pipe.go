@@ -0,0 +1,209 @@
+package device
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hedwig100/go-network/pkg/net"
+)
+
+const (
+	// number of frames which can be in flight on one direction of the pipe
+	pipeQueueSize = 100
+)
+
+// PipeInit returns a pair of ethernet devices connected to each other.
+// Frames transmitted by one end are received by the other end over a channel,
+// so two stacks can communicate in one process without tap device.
+// If stack is nil, the end is not registered to any stack and the frames can be
+// read and written directly by Recv and TxHandler (scripted peer).
+func PipeInit(stack0 *net.Net, name0 string, stack1 *net.Net, name1 string) (*Pipe, *Pipe, error) {
+
+	addr0, err := randomEtherAddr()
+	if err != nil {
+		return nil, nil, err
+	}
+	addr1, err := randomEtherAddr()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch0 := make(chan []byte, pipeQueueSize)
+	ch1 := make(chan []byte, pipeQueueSize)
+
+	p0 := &Pipe{
+		name:      name0,
+		flags:     net.DeviceFlagBroadcast | net.DeviceFlagNeedARP | net.DeviceFlagUp,
+		EtherAddr: addr0,
+		rx:        ch0,
+		tx:        ch1,
+		stack:     stack0,
+	}
+	p1 := &Pipe{
+		name:      name1,
+		flags:     net.DeviceFlagBroadcast | net.DeviceFlagNeedARP | net.DeviceFlagUp,
+		EtherAddr: addr1,
+		rx:        ch1,
+		tx:        ch0,
+		stack:     stack1,
+	}
+
+	if stack0 != nil {
+		stack0.DeviceRegister(p0)
+	}
+	if stack1 != nil {
+		stack1.DeviceRegister(p1)
+	}
+	return p0, p1, nil
+}
+
+// randomEtherAddr returns locally administered unicast address
+func randomEtherAddr() (EtherAddr, error) {
+	var addr EtherAddr
+	_, err := rand.Read(addr[:])
+	if err != nil {
+		return EtherAddr{}, err
+	}
+	addr[0] = addr[0]&0xfc | 0x02
+	return addr, nil
+}
+
+// Pipe is one end of the in-process ethernet link.
+// Pipe implements net.Device interface
+type Pipe struct {
+
+	// name
+	name string
+
+	// flags represents device state and device type
+	flags uint16
+
+	// interfaces tied to the device
+	interfaces []net.Interface
+
+	// ethernet address
+	EtherAddr
+
+	// frames from the other end
+	rx chan []byte
+
+	// frames to the other end
+	tx chan []byte
+
+	// stack to which the device belongs
+	stack *net.Net
+}
+
+func (p *Pipe) Name() string {
+	return p.name
+}
+
+func (p *Pipe) Type() net.DeviceType {
+	return net.DeviceTypeEther
+}
+
+func (p *Pipe) MTU() uint16 {
+	return EtherPayloadSizeMax
+}
+
+func (p *Pipe) Flags() uint16 {
+	return p.flags
+}
+
+func (p *Pipe) Addr() net.HardwareAddr {
+	return p.EtherAddr
+}
+
+func (p *Pipe) AddIface(iface net.Interface) {
+	p.interfaces = append(p.interfaces, iface)
+}
+
+func (p *Pipe) Interfaces() []net.Interface {
+	if p.interfaces == nil {
+		return []net.Interface{}
+	}
+	return p.interfaces
+}
+
+func (p *Pipe) Close() error {
+	p.flags &^= net.DeviceFlagUp
+	return nil
+}
+
+func (p *Pipe) TxHandler(data []byte, typ net.ProtoType, dst net.HardwareAddr) error {
+
+	// dst must be Ethernet address
+	etherDst, ok := dst.(EtherAddr)
+	if !ok {
+		return fmt.Errorf("pipe device only supports ethernet address")
+	}
+
+	// put header and data into the data
+	hdr := EtherHeader{
+		Src:  p.EtherAddr,
+		Dst:  etherDst,
+		Type: typ,
+	}
+	data, err := header2data(hdr, data)
+	if err != nil {
+		return err
+	}
+
+	// the frame is lost if the other end does not read
+	select {
+	case p.tx <- data:
+	default:
+		return fmt.Errorf("pipe is full dev=%s", p.name)
+	}
+
+	log.Printf("[D] Pipe TxHandler: data is trasmitted by pipe-device(name=%s),header=%s", p.name, hdr)
+	return nil
+}
+
+func (p *Pipe) RxHandler(done chan struct{}) {
+	for {
+
+		// receive the frame unless finished
+		var frame []byte
+		select {
+		case <-done:
+			return
+		case frame = <-p.rx:
+		}
+
+		if len(frame) < EtherHeaderSize {
+			log.Printf("[E] Pipe rxHandler: frame size is too small")
+			continue
+		}
+
+		hdr, payload, err := data2header(frame)
+		if err != nil {
+			log.Printf("[E] dev=%s,%s", p.name, err.Error())
+			continue
+		}
+
+		// check if the address is for me
+		if hdr.Dst != p.EtherAddr && hdr.Dst != EtherAddrBroadcast {
+			continue
+		}
+
+		log.Printf("[D] Pipe rxHandler: dev=%s,protocolType=%s,len=%d,header=%s", p.name, hdr.Type, len(frame), hdr)
+		p.stack.DeviceInputHanlder(hdr.Type, payload, p)
+	}
+}
+
+// Recv reads the frame from the other end directly and returns its header and payload.
+// This is used when the end is not registered to any stack.
+func (p *Pipe) Recv(timeout time.Duration) (EtherHeader, []byte, error) {
+	select {
+	case frame := <-p.rx:
+		if len(frame) < EtherHeaderSize {
+			return EtherHeader{}, nil, fmt.Errorf("frame size is too small")
+		}
+		return data2header(frame)
+	case <-time.After(timeout):
+		return EtherHeader{}, nil, fmt.Errorf("no frame arrived dev=%s", p.name)
+	}
+}
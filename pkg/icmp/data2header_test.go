@@ -3,6 +3,8 @@ package icmp
 import (
 	"log"
 	"testing"
+
+	"github.com/hedwig100/go-network/pkg/utils"
 )
 
 func compareByte(a []byte, b []byte) bool {
@@ -48,3 +50,22 @@ func Test2ICMP(t *testing.T) {
 		t.Error("ICMP payload transforrm not succeeded")
 	}
 }
+
+func TestCheckSumICMP(t *testing.T) {
+	hdr := Header{
+		Typ:    TypeEchoReply,
+		Code:   0,
+		Values: 109<<16 | 1,
+	}
+	payload := []byte("checksum covers the payload")
+
+	data, err := header2data(&hdr, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the checksum of the whole message including the checksum field is zero
+	if chksum := utils.CheckSum(data, 0); chksum != 0 && chksum != 0xffff {
+		t.Errorf("checksum error %x", chksum)
+	}
+}
@@ -76,7 +76,7 @@ func header2data(hdr *Header, payload []byte) ([]byte, error) {
 
 	// calculate checksum
 	buf := w.Bytes()
-	chksum := utils.CheckSum(buf[:HeaderSize], 0)
+	chksum := utils.CheckSum(buf, 0)
 	copy(buf[2:4], utils.Hton16(chksum))
 
 	// set checksum in the header (for debug)
@@ -1,6 +1,8 @@
 package icmp_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"os"
 	"os/signal"
 	"syscall"
@@ -8,9 +10,12 @@ import (
 	"time"
 
 	"github.com/hedwig100/go-network/pkg"
+	"github.com/hedwig100/go-network/pkg/arp"
 	"github.com/hedwig100/go-network/pkg/device"
 	"github.com/hedwig100/go-network/pkg/icmp"
 	"github.com/hedwig100/go-network/pkg/ip"
+	"github.com/hedwig100/go-network/pkg/net"
+	"github.com/hedwig100/go-network/pkg/utils"
 )
 
 const (
@@ -54,10 +59,15 @@ func TestICMP(t *testing.T) {
 
 	var err error
 
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// devices
-	_ = device.NullInit("null0")
-	loop := device.LoopbackInit("loop0")
-	ether, err := device.EtherInit("tap0")
+	_ = device.NullInit(s.Net, "null0")
+	loop := device.LoopbackInit(s.Net, "loop0")
+	ether, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,26 +77,21 @@ func TestICMP(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(loop, iface0)
+	s.IP.IfaceRegister(loop, iface0)
 
 	iface1, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(ether, iface1)
+	s.IP.IfaceRegister(ether, iface1)
 
 	// default gateway
-	err = ip.SetDefaultGateway(iface1, defaultGateway)
-	if err != nil {
-		t.Error(err)
-	}
-
-	err = pkg.NetInit(false)
+	err = s.IP.SetDefaultGateway(iface1, defaultGateway)
 	if err != nil {
 		t.Error(err)
 	}
 
-	pkg.NetRun()
+	s.Run()
 
 	src := iface1.Unicast
 	dst, _ := ip.Str2Addr("8.8.8.8") //net.Str2IPAddr(defaultGateway)
@@ -104,7 +109,7 @@ func TestICMP(t *testing.T) {
 			}
 
 			time.Sleep(time.Second)
-			err = icmp.TxHandler(icmp.TypeEcho, 0, (id<<16 | seq), testdata, src, ip.Addr(dst))
+			err = s.ICMP.TxHandler(icmp.TypeEcho, 0, (id<<16 | seq), testdata, src, ip.Addr(dst))
 			seq++
 			if seq > 1 && err != nil { // when seq=1(first time),we get cache not found error. this is not the error
 				t.Error(err)
@@ -112,7 +117,126 @@ func TestICMP(t *testing.T) {
 		}
 	}()
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// encode writes the headers and the payload in bigEndian
+func encode(t *testing.T, v ...interface{}) []byte {
+	var w bytes.Buffer
+	for _, x := range v {
+		if err := binary.Write(&w, binary.BigEndian, x); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Bytes()
+}
+
+/*
+
+go test -v ./pkg/icmp/ -run TestICMPPipe
+
+the stack is pinged by the scripted peer over the pipe device
+
+*/
+
+func TestICMPPipe(t *testing.T) {
+	var err error
+
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// devices, the other end is the scripted peer
+	dev, peer, err := device.PipeInit(s.Net, "pipe0", nil, "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// iface
+	iface, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.IP.IfaceRegister(dev, iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Run()
+
+	peerAddr, _ := ip.Str2Addr(defaultGateway)
+
+	// ARP request from the peer
+	req := encode(t, arp.ArpEther{
+		Header: arp.Header{Hrd: 0x0001, Pro: 0x0800, Hln: device.EtherAddrLen, Pln: ip.AddrLen, Op: 1},
+		Sha:    peer.EtherAddr,
+		Spa:    ip.Addr(peerAddr),
+		Tha:    device.EtherAddrAny,
+		Tpa:    iface.Unicast,
+	})
+	err = peer.TxHandler(req, net.ProtoTypeArp, device.EtherAddrBroadcast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, payload, err := peer.Recv(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep arp.ArpEther
+	binary.Read(bytes.NewReader(payload), binary.BigEndian, &rep)
+	if hdr.Type != net.ProtoTypeArp || rep.Op != 2 || rep.Sha != dev.EtherAddr || rep.Spa != iface.Unicast {
+		t.Fatalf("unexpected ARP reply %s", rep)
+	}
+
+	// ICMP echo from the peer
+	for seq := uint32(0); seq < 3; seq++ {
+		echo := icmp.Header{Typ: icmp.TypeEcho, Values: 109<<16 | seq}
+		msg := encode(t, echo, testdata)
+		copy(msg[2:4], utils.Hton16(utils.CheckSum(msg, 0)))
+
+		iphdr := ip.Header{
+			Vhl:       ip.V4<<4 | ip.HeaderSizeMin>>2,
+			Tol:       uint16(ip.HeaderSizeMin + len(msg)),
+			Ttl:       64,
+			ProtoType: ip.ProtoICMP,
+			Src:       ip.Addr(peerAddr),
+			Dst:       iface.Unicast,
+		}
+		packet := encode(t, iphdr, msg)
+		copy(packet[10:12], utils.Hton16(utils.CheckSum(packet[:ip.HeaderSizeMin], 0)))
+
+		err = peer.TxHandler(packet, net.ProtoTypeIP, dev.EtherAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr, payload, err = peer.Recv(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Type != net.ProtoTypeIP || len(payload) < ip.HeaderSizeMin+icmp.HeaderSize {
+			t.Fatalf("unexpected frame %s", hdr)
+		}
+		if chksum := utils.CheckSum(payload[ip.HeaderSizeMin:], 0); chksum != 0 && chksum != 0xffff {
+			t.Errorf("checksum error in ICMP echo reply")
+		}
+
+		var reply icmp.Header
+		binary.Read(bytes.NewReader(payload[ip.HeaderSizeMin:]), binary.BigEndian, &reply)
+		if reply.Typ != icmp.TypeEchoReply || reply.Values != echo.Values {
+			t.Errorf("unexpected ICMP reply %s", reply)
+		}
+		if !bytes.Equal(payload[ip.HeaderSizeMin+icmp.HeaderSize:], testdata) {
+			t.Errorf("ICMP echo reply has different data")
+		}
+	}
+
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
@@ -8,19 +8,26 @@ import (
 	"github.com/hedwig100/go-network/pkg/utils"
 )
 
-// Init prepare the ICMP protocol
-func Init() error {
-	err := ip.ProtoRegister(&Proto{})
-	return err
+// Init prepare the ICMP protocol and registers it to the IP protocol
+func Init(ipProto *ip.IProto) (*Proto, error) {
+	p := &Proto{ip: ipProto}
+	err := ipProto.ProtoRegister(p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
-type Proto struct{}
+// Proto is struct for ICMP protocol handler.
+type Proto struct {
+	ip *ip.IProto
+}
 
 func (p *Proto) Type() ip.ProtoType {
 	return ip.ProtoICMP
 }
 
-func TxHandler(typ MessageType, code MessageCode, values uint32, data []byte, src ip.Addr, dst ip.Addr) error {
+func (p *Proto) TxHandler(typ MessageType, code MessageCode, values uint32, data []byte, src ip.Addr, dst ip.Addr) error {
 
 	hdr := Header{
 		Typ:    typ,
@@ -35,7 +42,7 @@ func TxHandler(typ MessageType, code MessageCode, values uint32, data []byte, sr
 
 	log.Printf("[D] ICMP TxHanlder: %s => %s,header=%s", src, dst, hdr)
 
-	return ip.TxHandler(ip.ProtoICMP, data, src, dst)
+	return p.ip.TxHandler(ip.ProtoICMP, data, src, dst)
 }
 
 func (p *Proto) RxHandler(data []byte, src ip.Addr, dst ip.Addr, ipIface *ip.Iface) error {
@@ -62,7 +69,10 @@ func (p *Proto) RxHandler(data []byte, src ip.Addr, dst ip.Addr, ipIface *ip.Ifa
 			// message addressed to broadcast address. responds with the address of the received interface
 			dst = ipIface.Unicast
 		}
-		return TxHandler(TypeEchoReply, 0, hdr.Values, payload, dst, src)
+		return p.TxHandler(TypeEchoReply, 0, hdr.Values, payload, dst, src)
+	case TypeEchoReply:
+		log.Printf("[I] ICMP echo reply: %s => %s,id=%d,seq=%d", src, dst, hdr.Values>>16, hdr.Values&0xffff)
+		return nil
 	default:
 		return fmt.Errorf("ICMP header type is unknown")
 	}
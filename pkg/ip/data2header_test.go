@@ -58,3 +58,31 @@ func Test2IP(t *testing.T) {
 		t.Error("IPv4 payload transforrm not succeeded")
 	}
 }
+
+func Test2IPLength(t *testing.T) {
+	src, _ := Str2Addr("127.0.0.1")
+	dst, _ := Str2Addr("8.8.8.8")
+
+	// total length whose lower byte is smaller than the header length
+	payload := make([]byte, 752)
+	hdr := Header{
+		Vhl:       V4<<4 | HeaderSizeMin>>2,
+		Tol:       uint16(HeaderSizeMin + len(payload)),
+		Ttl:       64,
+		ProtoType: ProtoTCP,
+		Src:       Addr(src),
+		Dst:       Addr(dst),
+	}
+
+	data, err := header2data(&hdr, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newPayload, err := data2header(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newPayload) != len(payload) {
+		t.Errorf("payload length = %d, want %d", len(newPayload), len(payload))
+	}
+}
@@ -79,10 +79,10 @@ func data2header(data []byte) (Header, []byte, error) {
 
 	// check header length and total length
 	hlen := (hdr.Vhl & 0xf) << 2
-	if uint8(len(data)) < hlen {
+	if len(data) < int(hlen) {
 		return Header{}, nil, fmt.Errorf("data length is smaller than IHL")
 	}
-	if uint16(len(data)) < hdr.Tol {
+	if len(data) < int(hdr.Tol) {
 		return Header{}, nil, fmt.Errorf("data length is smaller than Total Length")
 	}
 
@@ -57,10 +57,14 @@ func NewIface(unicastStr string, netmaskStr string) (iface *Iface, err error) {
 }
 
 // IfaceRegister registers ipIface to dev
-func IfaceRegister(dev net.Device, ipIface *Iface) {
-	net.IfaceRegister(dev, ipIface)
+func (p *IProto) IfaceRegister(dev net.Device, ipIface *Iface) error {
+	err := p.stack.IfaceRegister(dev, ipIface)
+	if err != nil {
+		return err
+	}
 
 	// register subnet's routing information to routing table
 	// this information is used when data is sent to the subnet's host
-	routeAdd(ipIface.Unicast&ipIface.netmask, ipIface.netmask, AddrAny, ipIface)
+	p.routeAdd(ipIface.Unicast&ipIface.netmask, ipIface.netmask, AddrAny, ipIface)
+	return nil
 }
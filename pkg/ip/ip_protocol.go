@@ -11,6 +11,15 @@ const (
 	ProtoUDP  ProtoType = 0x11
 )
 
+// ECN codepoint in the lower 2 bits of TOS field (RFC3168)
+const (
+	ECNNotECT uint8 = 0b00
+	ECNECT1   uint8 = 0b01
+	ECNECT0   uint8 = 0b10
+	ECNCE     uint8 = 0b11
+	ECNMask   uint8 = 0b11
+)
+
 /*
 	ProtoType is type of the upper protocol of IP
 */
@@ -34,8 +43,6 @@ func (p ProtoType) String() string {
 	IP Protocols
 */
 
-var protos []Proto
-
 // Proto is the upper protocol of IP such as TCP,UDP
 type Proto interface {
 
@@ -46,17 +53,28 @@ type Proto interface {
 	RxHandler(data []byte, src Addr, dst Addr, iface *Iface) error
 }
 
+// TosProto is the upper protocol which also receives TOS field of the packet, such as TCP with ECN.
+// RxHandlerTos is called instead of RxHandler if the protocol implements it.
+type TosProto interface {
+	Proto
+
+	// Receive Handler with TOS field
+	RxHandlerTos(data []byte, src Addr, dst Addr, tos uint8, iface *Iface) error
+}
+
 // ProtoRegister is used to register ip.Proto
-func ProtoRegister(proto Proto) error {
+func (p *IProto) ProtoRegister(proto Proto) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
 	// check if the same type IpUpperProtocol is already registered
-	for _, registerd := range protos {
+	for _, registerd := range p.protos {
 		if registerd.Type() == proto.Type() {
 			return fmt.Errorf("IP protocol(type=%s) is already registerd", proto.Type())
 		}
 	}
 
-	protos = append(protos, proto)
+	p.protos = append(p.protos, proto)
 	log.Printf("[I] registered proto=%s", proto.Type())
 	return nil
 }
@@ -38,10 +38,15 @@ var testdata = []byte{
 func TestIP(t *testing.T) {
 	var err error
 
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// devices
-	_ = device.NullInit("null0")
-	loop := device.LoopbackInit("loop0")
-	ether, err := device.EtherInit("tap0")
+	_ = device.NullInit(s.Net, "null0")
+	loop := device.LoopbackInit(s.Net, "loop0")
+	ether, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Error(err)
 	}
@@ -51,25 +56,20 @@ func TestIP(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	ip.IfaceRegister(loop, iface0)
+	s.IP.IfaceRegister(loop, iface0)
 
 	iface1, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
 	if err != nil {
 		t.Error(err)
 	}
-	ip.IfaceRegister(ether, iface1)
+	s.IP.IfaceRegister(ether, iface1)
 
 	// default gateway
-	err = ip.SetDefaultGateway(iface0, defaultGateway)
+	err = s.IP.SetDefaultGateway(iface0, defaultGateway)
 	if err != nil {
 		return
 	}
 
-	err = pkg.NetInit(false)
-	if err != nil {
-		t.Error(err)
-	}
-
 	for i := 0; i < 5; i++ {
 		time.Sleep(time.Millisecond)
 		err = net.DeviceOutput(ether, testdata, net.ProtoTypeIP, device.EtherAddrAny)
@@ -78,7 +78,7 @@ func TestIP(t *testing.T) {
 		}
 	}
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
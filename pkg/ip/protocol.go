@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"sync"
 
 	"github.com/hedwig100/go-network/pkg/device"
 	"github.com/hedwig100/go-network/pkg/net"
@@ -18,17 +19,18 @@ const (
 	AddrLen        uint8 = 4
 )
 
-var (
-	// NOTE: resolver is arp.ArpResolver
-	resolve func(net.Interface, Addr) (net.HardwareAddr, error)
-)
-
-// Init prepares the IP protocol
+// Init prepares the IP protocol and registers it to the stack
 // this receives arp.Resolver
-func Init(resolver func(net.Interface, Addr) (net.HardwareAddr, error)) error {
-	resolve = resolver
-	err := net.ProtoRegister(&IProto{})
-	return err
+func Init(stack *net.Net, resolver func(net.Interface, Addr) (net.HardwareAddr, error)) (*IProto, error) {
+	p := &IProto{
+		stack:   stack,
+		resolve: resolver,
+	}
+	err := stack.ProtoRegister(p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 /*
@@ -53,14 +55,37 @@ func (a Addr) String() string {
 */
 
 // IProto is struct for IP Protocol. This implements protocol interface.
-type IProto struct{}
+type IProto struct {
+	mutex sync.Mutex
+
+	// stack to which the protocol belongs
+	stack *net.Net
+
+	// NOTE: resolver is arp.ArpResolver
+	resolve func(net.Interface, Addr) (net.HardwareAddr, error)
+
+	// routing table
+	routes []route
+
+	// upper protocols
+	protos []Proto
+
+	// identification of the last packet
+	id uint16
+}
 
 func (p *IProto) Type() net.ProtoType {
 	return net.ProtoTypeIP
 }
 
 // TxHandler receives data from IPUpperProtocol and transmit the data with the device
-func TxHandler(proto ProtoType, data []byte, src Addr, dst Addr) error {
+func (p *IProto) TxHandler(proto ProtoType, data []byte, src Addr, dst Addr) error {
+	return p.TxHandlerTos(proto, data, src, dst, 0)
+}
+
+// TxHandlerTos is the same as TxHandler except that the TOS field of the header is tos,
+// the upper protocol sets the ECN codepoint with it.
+func (p *IProto) TxHandlerTos(proto ProtoType, data []byte, src Addr, dst Addr, tos uint8) error {
 
 	// if dst is broadcast address, source is required
 	if src == AddrAny && dst == AddrBroadcast {
@@ -68,7 +93,7 @@ func TxHandler(proto ProtoType, data []byte, src Addr, dst Addr) error {
 	}
 
 	// look up routing table
-	route, err := LookupTable(dst)
+	route, err := p.LookupTable(dst)
 	if err != nil {
 		return err
 	}
@@ -94,8 +119,9 @@ func TxHandler(proto ProtoType, data []byte, src Addr, dst Addr) error {
 	// transform IP header to byte strings
 	hdr := Header{
 		Vhl:       (V4<<4 | HeaderSizeMin>>2),
+		Tos:       tos,
 		Tol:       uint16(HeaderSizeMin + len(data)),
-		Id:        generateId(),
+		Id:        p.generateId(),
 		Flags:     0,
 		Ttl:       0xff,
 		ProtoType: proto,
@@ -114,7 +140,7 @@ func TxHandler(proto ProtoType, data []byte, src Addr, dst Addr) error {
 		if nexthop == iface.broadcast || nexthop == AddrBroadcast {
 			hwaddr = device.EtherAddrBroadcast // TODO: not only ethernet
 		} else {
-			hwaddr, err = resolve(iface, nexthop) // NOTE: resolver is arp.ArpResolver
+			hwaddr, err = p.resolve(iface, nexthop) // NOTE: resolver is arp.ArpResolver
 			if err != nil {
 				return err
 			}
@@ -130,16 +156,13 @@ func (p *IProto) RxHandler(ch chan net.ProtoBuffer, done chan struct{}) {
 
 	for {
 
-		// check if finished or not
+		// receive data from device unless finished
 		select {
 		case <-done:
 			return
-		default:
+		case pb = <-ch:
 		}
 
-		// receive data from device
-		pb = <-ch
-
 		// extract the header from the beginning of the data
 		hdr, payload, err := data2header(pb.Data)
 		if err != nil {
@@ -168,9 +191,16 @@ func (p *IProto) RxHandler(ch chan net.ProtoBuffer, done chan struct{}) {
 		log.Printf("[D] IP rxHandler: iface=%s,protocol=%s,header=%v", iface.Unicast, hdr.ProtoType, hdr)
 
 		// search the protocol whose type is the same as the header's one
+		p.mutex.Lock()
+		protos := p.protos
+		p.mutex.Unlock()
 		for _, proto := range protos {
 			if proto.Type() == hdr.ProtoType {
-				err = proto.RxHandler(payload, hdr.Src, hdr.Dst, iface)
+				if tp, ok := proto.(TosProto); ok {
+					err = tp.RxHandlerTos(payload, hdr.Src, hdr.Dst, hdr.Tos, iface)
+				} else {
+					err = proto.RxHandler(payload, hdr.Src, hdr.Dst, iface)
+				}
 				if err != nil {
 					log.Printf("[E] IP RxHanlder: %s", err.Error())
 				}
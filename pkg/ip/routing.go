@@ -7,8 +7,6 @@ import (
 	"github.com/hedwig100/go-network/pkg/utils"
 )
 
-var routes []route
-
 // route is routing table entry
 type route struct {
 	network Addr
@@ -18,8 +16,11 @@ type route struct {
 }
 
 // routeAdd add routing table entry to routing table
-func routeAdd(network Addr, netmask Addr, nexthop Addr, iface *Iface) {
-	routes = append(routes, route{
+func (p *IProto) routeAdd(network Addr, netmask Addr, nexthop Addr, iface *Iface) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.routes = append(p.routes, route{
 		network: network,
 		netmask: netmask,
 		nexthop: nexthop,
@@ -30,7 +31,7 @@ func routeAdd(network Addr, netmask Addr, nexthop Addr, iface *Iface) {
 
 // SetDefaultGateway sets gw address as default gateway of ipIface
 // ex) gw = "127.0.0.1"
-func SetDefaultGateway(ipIface *Iface, gw string) error {
+func (p *IProto) SetDefaultGateway(ipIface *Iface, gw string) error {
 
 	// convert to uint32
 	gwaddr, err := Str2Addr(gw)
@@ -38,24 +39,27 @@ func SetDefaultGateway(ipIface *Iface, gw string) error {
 		return err
 	}
 
-	routeAdd(AddrAny, AddrAny, Addr(gwaddr), ipIface)
+	p.routeAdd(AddrAny, AddrAny, Addr(gwaddr), ipIface)
 	return nil
 }
 
 // LookupTable find routing table entry whose network dst is sent
-func LookupTable(dst Addr) (route, error) {
+func (p *IProto) LookupTable(dst Addr) (route, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
 	var candidate *route
 
 	// search routing table
-	for _, route := range routes {
+	for i := range p.routes {
+		route := &p.routes[i]
 
 		// check if dst is the subnet of the route
 		if uint32(dst)&uint32(route.netmask) == uint32(route.network) {
 
 			// longest match
 			if candidate == nil || utils.Ntoh32(uint32(candidate.netmask)) < utils.Ntoh32(uint32(route.netmask)) {
-				candidate = &route
+				candidate = route
 			}
 		}
 	}
@@ -20,10 +20,10 @@ func Str2Addr(str string) (uint32, error) {
 	return b, nil
 }
 
-var id uint16 = 0
-
 // generateId() generates id for IP header
-func generateId() uint16 {
-	id++
-	return id
+func (p *IProto) generateId() uint16 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.id++
+	return p.id
 }
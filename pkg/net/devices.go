@@ -19,8 +19,6 @@ const (
 	DeviceFlagNeedARP   uint16 = 0x0100
 )
 
-var devices []Device
-
 /*
 	Device
 */
@@ -63,24 +61,41 @@ func isUp(d Device) bool {
 }
 
 // DeviceRegister registers the device
-func DeviceRegister(dev Device) {
-	devices = append(devices, dev)
+func (n *Net) DeviceRegister(dev Device) {
+	n.mutex.Lock()
+	n.devices = append(n.devices, dev)
+	n.mutex.Unlock()
 	log.Printf("[I] registerd dev=%s", dev.Name())
 }
 
 // DeviceInputHandler receives data from the device and passes it to the protocol.
-func DeviceInputHanlder(typ ProtoType, data []byte, dev Device) {
+func (n *Net) DeviceInputHanlder(typ ProtoType, data []byte, dev Device) {
 	log.Printf("[I] input data dev=%s,typ=%s,data:%v", dev, typ, data)
 
-	for i, proto := range protos {
+	// search the buffer of the protocol
+	var buf chan ProtoBuffer
+	n.mutex.Lock()
+	for i, proto := range n.protos {
 		if proto.Type() == typ {
-			protoBuffers[i] <- ProtoBuffer{
-				Data: data,
-				Dev:  dev,
-			}
+			buf = n.protoBuffers[i]
 			break
 		}
 	}
+	n.mutex.Unlock()
+
+	if buf == nil {
+		return
+	}
+
+	// the data is dropped if the protocol cannot keep up with the device
+	select {
+	case buf <- ProtoBuffer{
+		Data: data,
+		Dev:  dev,
+	}:
+	default:
+		log.Printf("[E] protocol buffer is full, data is dropped dev=%s,typ=%s", dev.Name(), typ)
+	}
 }
 
 // DeviceOutput outputs the data from the device
@@ -31,8 +31,6 @@ func (f IfaceFamily) String() string {
 	Interface
 */
 
-var interfaces []Interface
-
 // Interface is a logical interface,
 // it serves as an entry point for devices and manages their addresses, etc
 type Interface interface {
@@ -48,7 +46,7 @@ type Interface interface {
 }
 
 // IfaceRegister register iface to deev
-func IfaceRegister(dev Device, iface Interface) error {
+func (n *Net) IfaceRegister(dev Device, iface Interface) error {
 
 	// device cannot have the same family interface
 	for _, registeredIface := range dev.Interfaces() {
@@ -60,7 +58,9 @@ func IfaceRegister(dev Device, iface Interface) error {
 	// add interface to the device
 	dev.AddIface(iface)
 	iface.SetDev(dev)
-	interfaces = append(interfaces, iface)
+	n.mutex.Lock()
+	n.interfaces = append(n.interfaces, iface)
+	n.mutex.Unlock()
 	log.Printf("[I] iface=%s is registerd dev=%s", iface.Family(), dev.Name())
 	return nil
 }
@@ -3,25 +3,53 @@ package net
 import (
 	"fmt"
 	"log"
+	"sync"
 )
 
+// Net holds the devices, the logical interfaces and the link-level protocols of
+// one protocol stack. Several Net can be used in one process independently.
+type Net struct {
+	mutex sync.Mutex
+
+	// devices registered to the stack
+	devices []Device
+
+	// logical interfaces registered to the stack
+	interfaces []Interface
+
+	// protocols and their buffers
+	protos       []Proto
+	protoBuffers []chan ProtoBuffer
+}
+
+// New returns an empty Net
+func New() *Net {
+	return &Net{}
+}
+
 // Open activate the receive handler of the device and
 // activate the receive handler of the protocol
-func Open(done chan struct{}) {
+func (n *Net) Open(done chan struct{}) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
 	// activate the receive handler of the device
-	for _, dev := range devices {
+	for _, dev := range n.devices {
 		go dev.RxHandler(done)
 	}
 
 	// activate the receive handler of the protocol
-	for i, proto := range protos {
-		go proto.RxHandler(protoBuffers[i], done)
+	for i, proto := range n.protos {
+		go proto.RxHandler(n.protoBuffers[i], done)
 	}
 }
 
 // Close closes all the devices
-func Close() (err error) {
-	for _, dev := range devices {
+func (n *Net) Close() (err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, dev := range n.devices {
 
 		if !isUp(dev) {
 			return fmt.Errorf("already closed dev=%s", dev.Name())
@@ -33,9 +33,6 @@ func (pt ProtoType) String() string {
 
 const ProtoBufferSize = 100
 
-var protos []Proto
-var protoBuffers []chan ProtoBuffer
-
 // Proto is the ans abstraction of protocol
 type Proto interface {
 
@@ -57,12 +54,14 @@ type ProtoBuffer struct {
 }
 
 // ProtoRegister registers the  protocol
-func ProtoRegister(proto Proto) (err error) {
+func (n *Net) ProtoRegister(proto Proto) (err error) {
 
 	// add thee protocol
 	ch := make(chan ProtoBuffer, ProtoBufferSize)
-	protos = append(protos, proto)
-	protoBuffers = append(protoBuffers, ch)
+	n.mutex.Lock()
+	n.protos = append(n.protos, proto)
+	n.protoBuffers = append(n.protoBuffers, ch)
+	n.mutex.Unlock()
 
 	log.Printf("[I] registerd proto=%s", proto.Type())
 	return
@@ -0,0 +1,75 @@
+package port
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/hedwig100/go-network/pkg/ip"
+)
+
+/*
+	Ephemeral port allocator
+*/
+
+// the range of the ephemeral port (RFC6335)
+const (
+	Min uint16 = 49152
+	Max uint16 = 65535
+)
+
+// Allocator chooses the ephemeral port in the range [Min,Max]
+// with the simple hash-based port selection algorithm (RFC6056 Algorithm 3).
+// The search starts at the offset which is the hash of the endpoints and the secret,
+// so the port is hard to guess for the off-path attacker and
+// the ports for the different foreigns hardly collide with each other.
+// It is shared by UDP and TCP, and not safe for concurrent use,
+// the protocol calls it holding its mutex.
+type Allocator struct {
+
+	// the secret key of the hash, chosen at random
+	secret [16]byte
+
+	// incremented every time a port is tried
+	next uint32
+}
+
+// NewAllocator returns Allocator with the random secret
+func NewAllocator() (*Allocator, error) {
+	var buf [20]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, fmt.Errorf("secret of the port allocator cannot be generated %s", err.Error())
+	}
+	a := &Allocator{next: binary.BigEndian.Uint32(buf[16:])}
+	copy(a.secret[:], buf[:16])
+	return a, nil
+}
+
+// Allocate returns the ephemeral port for the communication from local to foreign:foreignPort.
+// inUse reports whether the port cannot be used, the next candidate is tried if it returns true.
+// Either of the addresses may be unspecified.
+func (a *Allocator) Allocate(local ip.Addr, foreign ip.Addr, foreignPort uint16, inUse func(port uint16) bool) (uint16, error) {
+	num := uint32(Max-Min) + 1
+	offset := a.offset(local, foreign, foreignPort)
+	for count := uint32(0); count < num; count++ {
+		port := Min + uint16((offset+a.next)%num)
+		a.next++
+		if !inUse(port) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("there is no port number to assign")
+}
+
+// offset is F(local IP, remote IP, remote port, secret) in RFC6056,
+// the keyed cryptographic hash so that the secret cannot be derived from the ports.
+func (a *Allocator) offset(local ip.Addr, foreign ip.Addr, foreignPort uint16) uint32 {
+	var buf [26]byte
+	copy(buf[:16], a.secret[:])
+	binary.BigEndian.PutUint32(buf[16:20], uint32(local))
+	binary.BigEndian.PutUint32(buf[20:24], uint32(foreign))
+	binary.BigEndian.PutUint16(buf[24:26], foreignPort)
+	sum := sha256.Sum256(buf[:])
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,43 @@
+package port
+
+import (
+	"testing"
+
+	"github.com/hedwig100/go-network/pkg/ip"
+)
+
+func TestAllocator(t *testing.T) {
+	a, err := NewAllocator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := ip.AddrAny
+	foreign := ip.Addr(0xc0000201)
+
+	// every port is allocated once
+	used := make(map[uint16]bool)
+	inUse := func(port uint16) bool {
+		return used[port]
+	}
+	num := int(Max-Min) + 1
+	for i := 0; i < num; i++ {
+		port, err := a.Allocate(local, foreign, 7, inUse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port < Min || used[port] {
+			t.Fatalf("port %d is allocated, which is out of range or used", port)
+		}
+		used[port] = true
+	}
+	if _, err := a.Allocate(local, foreign, 7, inUse); err == nil {
+		t.Error("port is allocated though every port is used")
+	}
+
+	// the consecutive allocations for the same foreign do not return the same port
+	first, _ := a.Allocate(local, foreign, 7, func(uint16) bool { return false })
+	second, _ := a.Allocate(local, foreign, 7, func(uint16) bool { return false })
+	if first == second {
+		t.Errorf("the same port %d is allocated twice", first)
+	}
+}
@@ -10,77 +10,116 @@ import (
 	"github.com/hedwig100/go-network/pkg/udp"
 )
 
-var done chan struct{} = make(chan struct{})
+// Stack is a protocol stack. It owns the devices, the interfaces, the routing table,
+// the arp cache and the protocol control blocks, so several stacks can run in one process.
+type Stack struct {
+	Net  *net.Net
+	IP   *ip.IProto
+	ARP  *arp.Proto
+	ICMP *icmp.Proto
+	UDP  *udp.Proto
+	TCP  *tcp.Proto
+
+	// closed when the stack is shut down
+	done chan struct{}
+}
+
+// NewStack prepares all the protocols of a new stack.
+// Devices and interfaces should be registered before Run is called.
+func NewStack() (*Stack, error) {
+	s := &Stack{
+		Net:  net.New(),
+		done: make(chan struct{}),
+	}
+
+	var err error
+	s.ARP, err = arp.Init(s.Net, s.done)
+	if err != nil {
+		return nil, err
+	}
+
+	s.IP, err = ip.Init(s.Net, s.ARP.Resolve)
+	if err != nil {
+		return nil, err
+	}
+
+	s.ICMP, err = icmp.Init(s.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	s.UDP, err = udp.Init(s.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	s.TCP, err = tcp.Init(s.IP, s.done)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NetInit returns a new stack. If setup is true, null0,loop0 and tap0 devices
+// and their interfaces are registered to the stack.
+func NetInit(setup bool) (*Stack, error) {
 
-func NetInit(setup bool) error {
+	s, err := NewStack()
+	if err != nil {
+		return nil, err
+	}
 
 	if setup {
-		_ = device.NullInit("null0")
-		loop := device.LoopbackInit("loop0")
-		ether, err := device.EtherInit("tap0")
+		_ = device.NullInit(s.Net, "null0")
+		loop := device.LoopbackInit(s.Net, "loop0")
+		ether, err := device.EtherInit(s.Net, "tap0")
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// iface
 		iface0, err := ip.NewIface("127.0.0.1", "255.0.0.0")
 		if err != nil {
-			return err
+			return nil, err
+		}
+		err = s.IP.IfaceRegister(loop, iface0)
+		if err != nil {
+			return nil, err
 		}
-		ip.IfaceRegister(loop, iface0)
 
 		iface1, err := ip.NewIface("192.0.2.2", "255.255.255.0")
 		if err != nil {
-			return err
+			return nil, err
+		}
+		err = s.IP.IfaceRegister(ether, iface1)
+		if err != nil {
+			return nil, err
 		}
-		ip.IfaceRegister(ether, iface1)
 
 		// default gateway
-		err = ip.SetDefaultGateway(iface1, "192.0.2.1")
+		err = s.IP.SetDefaultGateway(iface1, "192.0.2.1")
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	err := ip.Init(arp.Resolve)
-	if err != nil {
-		return err
-	}
-
-	err = arp.Init(done)
-	if err != nil {
-		return err
-	}
-
-	err = icmp.Init()
-	if err != nil {
-		return err
-	}
-
-	err = udp.Init()
-	if err != nil {
-		return err
-	}
-
-	err = tcp.Init(done)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return s, nil
 }
 
-func NetRun() {
-	net.Open(done)
+// Run activates the devices and the protocols of the stack
+func (s *Stack) Run() {
+	s.Net.Open(s.done)
 }
 
-func NetShutdown() (err error) {
+// Shutdown stops the stack
+func (s *Stack) Shutdown() (err error) {
 
 	// shutdown all rxHandler
-	close(done)
+	close(s.done)
 
 	// close devices
-	if err = net.Close(); err != nil {
+	if err = s.Net.Close(); err != nil {
 		return
 	}
 	return
@@ -0,0 +1,85 @@
+package tcp
+
+/*
+	Ring buffer
+*/
+
+const (
+	// the ring buffer is allocated with this size at first
+	ringBufferMinSize = 4096
+)
+
+// ringBuffer is a byte queue which grows on demand,
+// no memory is allocated until the data is written.
+type ringBuffer struct {
+	buf  []byte
+	head int
+	n    int
+}
+
+// Len returns the length of the data in the buffer
+func (r *ringBuffer) Len() int {
+	return r.n
+}
+
+// write appends the data to the buffer, the buffer grows if there is no space
+func (r *ringBuffer) write(data []byte) {
+	if r.n+len(data) > len(r.buf) {
+		r.grow(r.n + len(data))
+	}
+	if len(data) == 0 {
+		return
+	}
+	tail := (r.head + r.n) % len(r.buf)
+	c := copy(r.buf[tail:], data)
+	copy(r.buf, data[c:])
+	r.n += len(data)
+}
+
+// read moves the data from the buffer to p and returns its length
+func (r *ringBuffer) read(p []byte) int {
+	n := r.peek(p)
+	if n == 0 {
+		return 0
+	}
+	r.head = (r.head + n) % len(r.buf)
+	r.n -= n
+	if r.n == 0 {
+		r.head = 0
+	}
+	return n
+}
+
+// peek copies the data to p without removing it from the buffer
+func (r *ringBuffer) peek(p []byte) int {
+	n := r.n
+	if n > len(p) {
+		n = len(p)
+	}
+	if n == 0 {
+		return 0
+	}
+	end := r.head + n
+	if end > len(r.buf) {
+		end = len(r.buf)
+	}
+	c := copy(p[:n], r.buf[r.head:end])
+	copy(p[c:n], r.buf)
+	return n
+}
+
+// grow reallocates the buffer whose size is at least min,
+// the size is doubled so that the data is not copied so many times.
+func (r *ringBuffer) grow(min int) {
+	size := 2 * len(r.buf)
+	if size < ringBufferMinSize {
+		size = ringBufferMinSize
+	}
+	for size < min {
+		size *= 2
+	}
+	buf := make([]byte, size)
+	r.peek(buf)
+	r.buf = buf
+	r.head = 0
+}
@@ -0,0 +1,262 @@
+package tcp
+
+import (
+	"math"
+	"time"
+)
+
+/*
+	Congestion Control
+*/
+
+// CongestionControl is congestion control algorithm of the connection.
+// The pcb detects the events (new ACK, duplicate ACK, retransmission timeout)
+// and the algorithm decides the congestion window.
+// Fast retransmit and fast recovery (RFC6582) are done by the pcb.
+type CongestionControl interface {
+
+	// Name returns the name of the algorithm
+	Name() string
+
+	// Init initializes the state, this is called when the connection is established
+	Init(mss uint32)
+
+	// Window returns the congestion window in bytes
+	Window() uint32
+
+	// OnAck is called when new data is acknowledged outside of fast recovery.
+	// rtt is the smoothed round-trip time of the connection.
+	OnAck(acked uint32, rtt time.Duration)
+
+	// OnFastRetransmit is called when the third duplicate ACK arrives and fast recovery starts,
+	// flight is the amount of the outstanding data. If sack is true, the window is set to ssthresh
+	// without the inflation by the duplicate ACKs (RFC6675).
+	OnFastRetransmit(flight uint32, sack bool)
+
+	// OnDupAck is called when the duplicate ACK arrives in fast recovery without SACK
+	OnDupAck()
+
+	// OnPartialAck is called when the ACK acknowledges some but not all of the data
+	// outstanding when fast recovery started without SACK.
+	OnPartialAck(acked uint32)
+
+	// OnRecoveryExit is called when fast recovery finishes
+	OnRecoveryExit(flight uint32)
+
+	// OnTimeout is called when the retransmission timer expires
+	OnTimeout(flight uint32)
+
+	// OnECE is called when ECN-Echo arrives, the window is reduced
+	// as for the loss but nothing is retransmitted (RFC3168).
+	OnECE(flight uint32)
+}
+
+// initialWindow returns the initial window (RFC3390)
+func initialWindow(mss uint32) uint32 {
+	if mss > 2190 {
+		return 2 * mss
+	}
+	if mss > 1095 {
+		return 3 * mss
+	}
+	return 4 * mss
+}
+
+func max32(a uint32, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min32(a uint32, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+/*
+	NewReno (RFC5681,RFC6582)
+*/
+
+// NewReno is the default congestion control algorithm.
+type NewReno struct {
+	mss      uint32
+	cwnd     uint32
+	ssthresh uint32
+}
+
+func (r *NewReno) Name() string {
+	return "newreno"
+}
+
+func (r *NewReno) Init(mss uint32) {
+	r.mss = mss
+	r.cwnd = initialWindow(mss)
+	r.ssthresh = math.MaxUint32
+}
+
+func (r *NewReno) Window() uint32 {
+	return r.cwnd
+}
+
+func (r *NewReno) OnAck(acked uint32, rtt time.Duration) {
+	if r.cwnd < r.ssthresh {
+		// slow start
+		r.cwnd += min32(acked, r.mss)
+		return
+	}
+	// congestion avoidance
+	r.cwnd += max32(r.mss*r.mss/r.cwnd, 1)
+}
+
+func (r *NewReno) OnFastRetransmit(flight uint32, sack bool) {
+	r.ssthresh = max32(flight/2, 2*r.mss)
+	r.cwnd = r.ssthresh
+	if !sack {
+		r.cwnd += 3 * r.mss
+	}
+}
+
+func (r *NewReno) OnDupAck() {
+	// inflate the window by the segment which has left the network
+	r.cwnd += r.mss
+}
+
+func (r *NewReno) OnPartialAck(acked uint32) {
+	// deflate the window by the amount of new data acknowledged
+	if acked >= r.cwnd {
+		r.cwnd = r.mss
+	} else {
+		r.cwnd -= acked
+	}
+	if acked >= r.mss {
+		r.cwnd += r.mss
+	}
+}
+
+func (r *NewReno) OnRecoveryExit(flight uint32) {
+	r.cwnd = min32(r.ssthresh, max32(flight, r.mss)+r.mss)
+}
+
+func (r *NewReno) OnTimeout(flight uint32) {
+	r.ssthresh = max32(flight/2, 2*r.mss)
+	r.cwnd = r.mss
+}
+
+func (r *NewReno) OnECE(flight uint32) {
+	r.ssthresh = max32(flight/2, 2*r.mss)
+	r.cwnd = r.ssthresh
+}
+
+/*
+	CUBIC (RFC8312)
+*/
+
+const (
+	cubicBeta = 0.7
+	cubicC    = 0.4
+)
+
+// Cubic is CUBIC congestion control algorithm,
+// fast recovery is the same as NewReno except the multiplicative decrease factor.
+type Cubic struct {
+	NewReno
+
+	// window size just before the last reduction (in segments)
+	wMax float64
+
+	// wMax before the last reduction, used for fast convergence
+	wLastMax float64
+
+	// time period to increase the window to wMax
+	k float64
+
+	// start of the current congestion avoidance stage
+	epochStart time.Time
+
+	// window estimated for Reno-friendly region (in segments)
+	wEst float64
+}
+
+func (c *Cubic) Name() string {
+	return "cubic"
+}
+
+func (c *Cubic) Init(mss uint32) {
+	c.NewReno.Init(mss)
+	c.wMax = 0
+	c.wLastMax = 0
+	c.epochStart = time.Time{}
+}
+
+func (c *Cubic) OnAck(acked uint32, rtt time.Duration) {
+	if c.cwnd < c.ssthresh {
+		c.NewReno.OnAck(acked, rtt)
+		return
+	}
+
+	cwnd := float64(c.cwnd) / float64(c.mss)
+	if c.epochStart.IsZero() {
+		c.epochStart = time.Now()
+		c.k = 0
+		if cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+		} else {
+			c.wMax = cwnd
+		}
+		c.wEst = cwnd
+	}
+
+	// window which should be reached after one RTT
+	t := time.Since(c.epochStart) + rtt
+	target := cubicC*math.Pow(t.Seconds()-c.k, 3) + c.wMax
+	if target > 1.5*cwnd {
+		target = 1.5 * cwnd
+	}
+
+	// Reno-friendly region
+	c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) * float64(acked) / float64(c.cwnd)
+	if c.wEst > target {
+		target = c.wEst
+	}
+
+	if target > cwnd {
+		inc := uint32((target - cwnd) / cwnd * float64(acked))
+		c.cwnd += max32(inc, 1)
+	}
+}
+
+// reduce records the window before the reduction and returns the new ssthresh
+func (c *Cubic) reduce(flight uint32) uint32 {
+	c.epochStart = time.Time{}
+
+	cwnd := float64(c.cwnd) / float64(c.mss)
+	if cwnd < c.wLastMax { // fast convergence
+		c.wLastMax = cwnd
+		c.wMax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wLastMax = cwnd
+		c.wMax = cwnd
+	}
+	return max32(uint32(float64(flight)*cubicBeta), 2*c.mss)
+}
+
+func (c *Cubic) OnFastRetransmit(flight uint32, sack bool) {
+	c.ssthresh = c.reduce(flight)
+	c.cwnd = c.ssthresh
+	if !sack {
+		c.cwnd += 3 * c.mss
+	}
+}
+
+func (c *Cubic) OnTimeout(flight uint32) {
+	c.ssthresh = c.reduce(flight)
+	c.cwnd = c.mss
+}
+
+func (c *Cubic) OnECE(flight uint32) {
+	c.ssthresh = c.reduce(flight)
+	c.cwnd = c.ssthresh
+}
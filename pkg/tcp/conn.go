@@ -0,0 +1,449 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// user timeout of the connections made by Dial and Listen
+	defaultUserTimeout = 5 * time.Minute
+)
+
+/*
+	TCP address
+*/
+
+// Addr is TCP endpoint which implements net.Addr
+type Addr struct {
+	Endpoint
+}
+
+func (a Addr) Network() string {
+	return "tcp"
+}
+
+/*
+	deadline
+*/
+
+// deadline is a deadline for blocking I/O, the channel returned by wait is closed when the deadline expires.
+type deadline struct {
+	mutex   sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{
+		expired: make(chan struct{}),
+	}
+}
+
+// set sets the deadline, zero value of t means no deadline
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // wait for the timer callback to finish
+	}
+	d.timer = nil
+
+	// renew the channel if the previous deadline has expired
+	select {
+	case <-d.expired:
+		d.expired = make(chan struct{})
+	default:
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.expired)
+		return
+	}
+
+	expired := d.expired
+	d.timer = time.AfterFunc(dur, func() {
+		close(expired)
+	})
+}
+
+// wait returns the channel which is closed when the deadline expires
+func (d *deadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.expired
+}
+
+/*
+	Connection
+*/
+
+// Conn is TCP connection, which implements net.Conn
+type Conn struct {
+	pcb *pcb
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	closeOnce sync.Once
+}
+
+func newConn(pcb *pcb) *Conn {
+	return &Conn{
+		pcb:           pcb,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+}
+
+// Dial opens the connection from local to remote actively
+// and waits until the connection is established or ctx is done.
+// The address and port of local may be zero, then the address of the interface
+// to remote and the ephemeral port are used.
+func (p *Proto) Dial(ctx context.Context, local Endpoint, remote Endpoint) (*Conn, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pcb, err := p.Newpcb(local)
+	if err != nil {
+		return nil, err
+	}
+
+	// OPEN returns after SYN is sent, so Abort below always sees the pcb in SYN-SENT,
+	// and errCh is notified when the connection is established.
+	errCh := make(chan error, 1)
+	pcb.Open(errCh, remote, true, defaultUserTimeout)
+
+	select {
+	case err = <-errCh:
+		if err != nil {
+			p.Deletepcb(pcb)
+			return nil, err
+		}
+		return newConn(pcb), nil
+	case <-ctx.Done():
+		pcb.Abort()
+		p.Deletepcb(pcb)
+		return nil, ctx.Err()
+	}
+}
+
+// Read reads data from the connection. It blocks until data arrives,
+// the foreign closes the connection (io.EOF) or the read deadline expires.
+func (c *Conn) Read(b []byte) (int, error) {
+	pcb := c.pcb
+	for {
+		pcb.proto.mutex.Lock()
+		switch pcb.state {
+		case PCBStateListen, PCBStateSYNSent, PCBStateSYNReceived:
+			pcb.proto.mutex.Unlock()
+			return 0, fmt.Errorf("connection does not exist")
+		}
+
+		if pcb.readShut {
+			pcb.proto.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if pcb.rxBuf.Len() > 0 {
+			n := pcb.read(b)
+			pcb.proto.mutex.Unlock()
+			return n, nil
+		}
+		if pcb.finReceived {
+			pcb.proto.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if pcb.state == PCBStateClosed {
+			err := pcb.err
+			pcb.proto.mutex.Unlock()
+			if err == nil {
+				err = fmt.Errorf("connection does not exist")
+			}
+			return 0, err
+		}
+		event := pcb.wait()
+		pcb.proto.mutex.Unlock()
+
+		select {
+		case <-event:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write writes data to the connection. It blocks until all of the data is copied
+// into the send buffer or the write deadline expires, it does not wait for
+// the foreign to acknowledge the data.
+func (c *Conn) Write(b []byte) (int, error) {
+
+	select {
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	return c.pcb.Write(b, c.writeDeadline.wait())
+}
+
+// WriteUrgent writes b to the connection as the urgent data, whose last octet
+// is read by ReadUrgent of the foreign unless it is received inline.
+func (c *Conn) WriteUrgent(b []byte) (int, error) {
+
+	select {
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	return c.pcb.WriteUrgent(b, c.writeDeadline.wait())
+}
+
+// ReadUrgent reads the urgent data (out-of-band) from the connection.
+// It blocks until the urgent data arrives, the foreign closes the connection (io.EOF) or the read deadline expires.
+func (c *Conn) ReadUrgent(b []byte) (int, error) {
+	return c.pcb.ReadUrgent(b, c.readDeadline.wait())
+}
+
+// SetOOBInline makes the urgent data received in the stream if inline is true, it is out-of-band by default.
+func (c *Conn) SetOOBInline(inline bool) error {
+	c.pcb.SetOOBInline(inline)
+	return nil
+}
+
+// AtMark reports whether the data read next follows the urgent data,
+// Read does not return the data across the mark at once.
+func (c *Conn) AtMark() bool {
+	return c.pcb.AtMark()
+}
+
+// Close closes the connection. By default it does not wait for the foreign to acknowledge the close,
+// the data in the send buffer and FIN are sent in the background (see SetLinger).
+// The pcb is deleted after it becomes CLOSED.
+func (c *Conn) Close() error {
+	err := fmt.Errorf("connection already closed")
+	c.closeOnce.Do(func() {
+		pcb := c.pcb
+
+		pcb.proto.mutex.Lock()
+		pcb.release = true
+		if pcb.state == PCBStateFINWait2 {
+			// the FIN-WAIT-2 timeout starts when the user closes the half-closed connection
+			pcb.finWait2Time = time.Now()
+			pcb.rearm()
+		}
+		if pcb.state == PCBStateClosed {
+			pcb.proto.remove(pcb)
+			pcb.proto.mutex.Unlock()
+			err = nil
+			return
+		}
+		if pcb.lingerOn && pcb.linger == 0 {
+			// abortive close, the unsent data is discarded
+			err = pcb.abort()
+			pcb.proto.mutex.Unlock()
+			return
+		}
+		closing := pcb.closing()
+		lingerOn, linger := pcb.lingerOn, pcb.linger
+		pcb.proto.mutex.Unlock()
+
+		// FIN is already sent or queued if CloseWrite was called
+		err = nil
+		if !closing {
+			errCh := make(chan error, 1)
+			pcb.Close(errCh)
+			select {
+			case err = <-errCh:
+			default: // waiting for the foreign
+			}
+		}
+		if err == nil && lingerOn {
+			err = c.lingerWait(linger)
+		}
+	})
+	return err
+}
+
+// lingerWait waits for FIN to be acknowledged,
+// the connection is reset if it is not acknowledged within timeout.
+func (c *Conn) lingerWait(timeout time.Duration) error {
+	pcb := c.pcb
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		pcb.proto.mutex.Lock()
+		if pcb.finAcked() {
+			pcb.proto.mutex.Unlock()
+			return nil
+		}
+		event := pcb.wait()
+		pcb.proto.mutex.Unlock()
+
+		select {
+		case <-event:
+		case <-timer.C:
+			pcb.proto.mutex.Lock()
+			defer pcb.proto.mutex.Unlock()
+			if pcb.finAcked() {
+				return nil
+			}
+			if err := pcb.abort(); err != nil {
+				return err
+			}
+			return fmt.Errorf("linger timeout, connection reset")
+		}
+	}
+}
+
+// CloseWrite shuts down the sending side of the connection, FIN is sent after the data in the send buffer.
+// The data from the foreign can still be read until io.EOF.
+func (c *Conn) CloseWrite() error {
+	errCh := make(chan error, 1)
+	c.pcb.Close(errCh)
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil // waiting for the foreign
+	}
+}
+
+// CloseRead shuts down the receiving side of the connection, Read returns io.EOF afterwards.
+func (c *Conn) CloseRead() error {
+	return c.pcb.CloseRead()
+}
+
+// SetLinger sets the behavior of Close when the data is not acknowledged yet (see pcb.SetLinger).
+func (c *Conn) SetLinger(sec int) error {
+	c.pcb.SetLinger(sec)
+	return nil
+}
+
+// SetCongestionControl sets the congestion control algorithm of the connection
+func (c *Conn) SetCongestionControl(cc CongestionControl) {
+	c.pcb.SetCongestionControl(cc)
+}
+
+// SetWriteBuffer sets the size of the send buffer of the connection
+func (c *Conn) SetWriteBuffer(bytes int) error {
+	return c.pcb.SetSendBuffer(bytes)
+}
+
+// SetReadBuffer sets the maximum size of the receive buffer of the connection,
+// the buffer grows up to the size as fast as the data is read.
+func (c *Conn) SetReadBuffer(bytes int) error {
+	return c.pcb.SetReceiveBuffer(bytes)
+}
+
+// SetKeepAlive enables or disables keepalive of the connection with the default parameters.
+func (c *Conn) SetKeepAlive(keepalive bool) error {
+	return c.pcb.SetKeepAlive(KeepAliveConfig{Enable: keepalive})
+}
+
+// SetKeepAliveConfig configures keepalive of the connection.
+func (c *Conn) SetKeepAliveConfig(config KeepAliveConfig) error {
+	return c.pcb.SetKeepAlive(config)
+}
+
+// SetNoDelay controls whether Nagle's algorithm is disabled, it is enabled by default.
+func (c *Conn) SetNoDelay(noDelay bool) error {
+	c.pcb.SetNoDelay(noDelay)
+	return nil
+}
+
+// Info returns the snapshot of the state of the connection (e.g. RTT and congestion window)
+func (c *Conn) Info() Info {
+	return c.pcb.Info()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return Addr{c.pcb.local}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return Addr{c.pcb.foreign}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+/*
+	Listener
+*/
+
+// Listener is TCP listener, which implements net.Listener
+type Listener struct {
+	pcb *pcb
+}
+
+// Listen opens the pcb passively at local and returns the listener
+func (p *Proto) Listen(local Endpoint) (*Listener, error) {
+
+	pcb, err := p.Newpcb(local)
+	if err != nil {
+		return nil, err
+	}
+
+	errCh := make(chan error, 1)
+	pcb.Open(errCh, Endpoint{}, false, defaultUserTimeout)
+	if err = <-errCh; err != nil {
+		p.Deletepcb(pcb)
+		return nil, err
+	}
+
+	return &Listener{pcb: pcb}, nil
+}
+
+// Accept waits for the connection to be established and returns it.
+func (l *Listener) Accept() (net.Conn, error) {
+	pcb, err := l.pcb.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newConn(pcb), nil
+}
+
+// Close stops listening, the connections which are not accepted yet are reset.
+func (l *Listener) Close() error {
+	errCh := make(chan error, 1)
+	l.pcb.Close(errCh)
+	if err := <-errCh; err != nil {
+		return err
+	}
+	return l.pcb.proto.Deletepcb(l.pcb)
+}
+
+// SetSYNCookies makes the listener reply SYN cookies when the backlog is full.
+func (l *Listener) SetSYNCookies(enable bool) {
+	l.pcb.SetSYNCookies(enable)
+}
+
+func (l *Listener) Addr() net.Addr {
+	return Addr{l.pcb.local}
+}
@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"log"
+	"reflect"
 	"testing"
 
 	"github.com/hedwig100/go-network/pkg/ip"
@@ -59,3 +60,40 @@ func Test2TCP(t *testing.T) {
 		t.Error("TCP payload transforrm not succeeded")
 	}
 }
+
+func Test2TCPOptions(t *testing.T) {
+	org := Options{MSS: 1460}
+	data := org.encode()
+	if len(data)%4 != 0 {
+		t.Errorf("options are not padded, len=%d", len(data))
+	}
+	if opts := parseOptions(data); !reflect.DeepEqual(opts, org) {
+		t.Errorf("options transform not succeeded, got %s, want %s", opts, org)
+	}
+
+	org = Options{
+		HasTimestamp: true,
+		TSVal:        1,
+		TSEcr:        2,
+		SACK:         []SACKBlock{{Left: 100, Right: 200}, {Left: 300, Right: 400}},
+	}
+	data = org.encode()
+	if len(data) != 12+4+2*optionLenSACKBlock {
+		t.Errorf("length of the options is %d", len(data))
+	}
+	if opts := parseOptions(data); !reflect.DeepEqual(opts, org) {
+		t.Errorf("options transform not succeeded, got %s, want %s", opts, org)
+	}
+
+	// NOP, unknown option (kind=30,len=3) and MSS
+	data = []byte{OptionKindNop, 30, 3, 0xff, OptionKindMSS, optionLenMSS, 0x02, 0x18, OptionKindEnd}
+	if opts := parseOptions(data); opts.MSS != 536 {
+		t.Errorf("MSS is %d, want 536", opts.MSS)
+	}
+
+	// malformed option
+	data = []byte{OptionKindMSS, 10, 0x05, 0xb4}
+	if opts := parseOptions(data); opts.MSS != 0 {
+		t.Errorf("MSS is %d, want 0", opts.MSS)
+	}
+}
@@ -0,0 +1,81 @@
+package tcp
+
+import (
+	"log"
+
+	"github.com/hedwig100/go-network/pkg/ip"
+)
+
+/*
+	Explicit Congestion Notification (RFC3168)
+*/
+
+// SetECN sets whether the connections opened afterwards negotiate ECN, it is enabled by default.
+func (p *Proto) SetECN(enable bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.ecn = enable
+}
+
+// agreeECN decides whether ECN is used from SYN of the foreign,
+// ECN-setup SYN has ECE and CWR, ECN-setup SYN-ACK has only ECE.
+func (pcb *pcb) agreeECN(flag ControlFlag) {
+	if isSet(flag, ACK) {
+		pcb.ecnOK = pcb.ecnOK && isSet(flag, ECE) && !isSet(flag, CWR)
+	} else {
+		pcb.ecnOK = pcb.ecnOK && isSet(flag, ECE) && isSet(flag, CWR)
+	}
+}
+
+// ecnFlags returns the flag and ECN codepoint of the segment to send.
+// Only new data is ECN-capable, pure ACKs, retransmissions and probes are not.
+func (pcb *pcb) ecnFlags(seq uint32, flag ControlFlag, data []byte) (ControlFlag, uint8) {
+	if !pcb.ecnOK {
+		return flag, ip.ECNNotECT
+	}
+	if isSet(flag, SYN) {
+		if isSet(flag, ACK) {
+			return flag | ECE, ip.ECNNotECT
+		}
+		return flag | ECE | CWR, ip.ECNNotECT
+	}
+
+	if isSet(flag, ACK) && pcb.ecnEcho {
+		flag |= ECE
+	}
+	if len(data) == 0 || seq != pcb.snd.nxt {
+		return flag, ip.ECNNotECT
+	}
+	if pcb.ecnCwr {
+		flag |= CWR
+		pcb.ecnCwr = false
+	}
+	return flag, ip.ECNECT0
+}
+
+// receiveECN echoes the congestion experienced with ECE until CWR arrives.
+// The segment with both of them sets ECE again since it tells the new congestion.
+func (pcb *pcb) receiveECN(seg segment, flag ControlFlag) {
+	if !pcb.ecnOK {
+		return
+	}
+	if isSet(flag, CWR) {
+		pcb.ecnEcho = false
+	}
+	if seg.ce {
+		pcb.ecnEcho = true
+	}
+}
+
+// ecnReduce reduces the congestion window when ECE arrives, at most once per window of data.
+// The window is not reduced again in fast recovery, which has already reduced it.
+func (pcb *pcb) ecnReduce() {
+	if pcb.inRecovery || (pcb.ecnReducing && seqLT(pcb.snd.una, pcb.ecnRecover)) {
+		return
+	}
+	pcb.ecnReducing = true
+	pcb.ecnRecover = pcb.snd.nxt
+	pcb.ecnCwr = true
+	pcb.cc.OnECE(pcb.snd.nxt - pcb.snd.una)
+	log.Printf("[D] TCP ECN-Echo local=%s,cwnd=%d", pcb.local, pcb.cc.Window())
+}
@@ -114,6 +114,178 @@ func (h Header) String() string {
 	`, h.Dst, h.Src, h.Seq, h.Ack, h.Offset>>4, h.Flag, h.Window, h.Checksum, h.Urgent)
 }
 
+/*
+	TCP Options
+*/
+
+const (
+	OptionKindEnd           uint8 = 0
+	OptionKindNop           uint8 = 1
+	OptionKindMSS           uint8 = 2
+	OptionKindWScale        uint8 = 3
+	OptionKindSACKPermitted uint8 = 4
+	OptionKindSACK          uint8 = 5
+	OptionKindTimestamp     uint8 = 8
+
+	optionLenMSS           = 4
+	optionLenWScale        = 3
+	optionLenSACKPermitted = 2
+	optionLenTimestamp     = 10
+	optionLenSACKBlock     = 8
+	optionLenMax           = 40 // data offset is at most 15 words
+
+	// maximum shift count of window scale (RFC7323)
+	maxWScale = 14
+)
+
+// SACKBlock is a block of the data received out of order (RFC2018),
+// Left is the first sequence number of the block and Right is the one next to the last.
+type SACKBlock struct {
+	Left  uint32
+	Right uint32
+}
+
+// Options is TCP options which this package supports.
+// Zero value of the field means the option is absent.
+type Options struct {
+
+	// maximum segment size, only in SYN segment
+	MSS uint16
+
+	// window scale shift count, only in SYN segment
+	HasWScale bool
+	WScale    uint8
+
+	// timestamps
+	HasTimestamp bool
+	TSVal        uint32
+	TSEcr        uint32
+
+	// SACK-permitted, only in SYN segment
+	SACKPermitted bool
+
+	// SACK blocks
+	SACK []SACKBlock
+}
+
+func (o Options) String() string {
+	str := fmt.Sprintf("MSS: %d", o.MSS)
+	if o.HasWScale {
+		str += fmt.Sprintf(",WScale: %d", o.WScale)
+	}
+	if o.HasTimestamp {
+		str += fmt.Sprintf(",TSVal: %d,TSEcr: %d", o.TSVal, o.TSEcr)
+	}
+	if o.SACKPermitted {
+		str += ",SACK-Permitted"
+	}
+	for _, b := range o.SACK {
+		str += fmt.Sprintf(",SACK: %d-%d", b.Left, b.Right)
+	}
+	return str
+}
+
+// parseOptions reads the options part of the header,
+// unknown options are skipped and malformed ones stop parsing.
+func parseOptions(data []byte) Options {
+	var opts Options
+	for i := 0; i < len(data); {
+		kind := data[i]
+		if kind == OptionKindEnd {
+			break
+		}
+		if kind == OptionKindNop {
+			i++
+			continue
+		}
+		if i+1 >= len(data) {
+			break
+		}
+		length := int(data[i+1])
+		if length < 2 || i+length > len(data) {
+			break
+		}
+
+		switch kind {
+		case OptionKindMSS:
+			if length == optionLenMSS {
+				opts.MSS = binary.BigEndian.Uint16(data[i+2 : i+4])
+			}
+		case OptionKindWScale:
+			if length == optionLenWScale {
+				opts.HasWScale = true
+				opts.WScale = data[i+2]
+			}
+		case OptionKindTimestamp:
+			if length == optionLenTimestamp {
+				opts.HasTimestamp = true
+				opts.TSVal = binary.BigEndian.Uint32(data[i+2 : i+6])
+				opts.TSEcr = binary.BigEndian.Uint32(data[i+6 : i+10])
+			}
+		case OptionKindSACKPermitted:
+			if length == optionLenSACKPermitted {
+				opts.SACKPermitted = true
+			}
+		case OptionKindSACK:
+			if (length-2)%optionLenSACKBlock == 0 {
+				for j := i + 2; j < i+length; j += optionLenSACKBlock {
+					opts.SACK = append(opts.SACK, SACKBlock{
+						Left:  binary.BigEndian.Uint32(data[j : j+4]),
+						Right: binary.BigEndian.Uint32(data[j+4 : j+8]),
+					})
+				}
+			}
+		}
+		i += length
+	}
+	return opts
+}
+
+// encode transforms the options to byte strings padded to a multiple of 4 bytes
+func (o Options) encode() []byte {
+	var buf []byte
+	if o.MSS > 0 {
+		buf = append(buf, OptionKindMSS, optionLenMSS)
+		buf = append(buf, utils.Hton16(o.MSS)...)
+	}
+	if o.HasWScale {
+		buf = append(buf, OptionKindNop, OptionKindWScale, optionLenWScale, o.WScale)
+	}
+	if o.HasTimestamp {
+		buf = append(buf, OptionKindNop, OptionKindNop, OptionKindTimestamp, optionLenTimestamp)
+		buf = append(buf, utils.Hton32(o.TSVal)...)
+		buf = append(buf, utils.Hton32(o.TSEcr)...)
+	}
+	if o.SACKPermitted {
+		buf = append(buf, OptionKindNop, OptionKindNop, OptionKindSACKPermitted, optionLenSACKPermitted)
+	}
+	if len(o.SACK) > 0 {
+		buf = append(buf, OptionKindNop, OptionKindNop, OptionKindSACK, uint8(2+optionLenSACKBlock*len(o.SACK)))
+		for _, b := range o.SACK {
+			buf = append(buf, utils.Hton32(b.Left)...)
+			buf = append(buf, utils.Hton32(b.Right)...)
+		}
+	}
+	for len(buf)%4 != 0 {
+		buf = append(buf, OptionKindEnd)
+	}
+	return buf
+}
+
+/*
+	Sequence number
+*/
+
+// seqLT returns a < b considering the wraparound of the sequence number
+func seqLT(a uint32, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// seqLE returns a <= b considering the wraparound of the sequence number
+func seqLE(a uint32, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
 // PseudoHeader is used for caluculating checksum.
 type PseudoHeader struct {
 
@@ -0,0 +1,93 @@
+package tcp
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+	Connection information (like TCP_INFO of Linux)
+*/
+
+// Info is the snapshot of the state of the connection
+type Info struct {
+	State   PCBState
+	Local   Endpoint
+	Foreign Endpoint
+
+	// send and receive sequence variables, SndWnd is the window advertised by the foreign
+	// and RcvWnd is the one advertised to the foreign
+	SndUna uint32
+	SndNxt uint32
+	SndWnd uint32
+	RcvNxt uint32
+	RcvWnd uint32
+	MSS    uint16
+
+	// smoothed round-trip time, round-trip time variation and retransmission timeout
+	RTT    time.Duration
+	RTTVar time.Duration
+	RTO    time.Duration
+
+	// congestion control algorithm, congestion window and the data sent but not acknowledged yet
+	CongestionControl string
+	Cwnd              uint32
+	BytesInFlight     uint32
+
+	// the number of the segments retransmitted and
+	// the data octets sent (including retransmissions) and received in sequence
+	Retransmits   uint64
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// String returns the information in one line like ss command
+func (info Info) String() string {
+	return fmt.Sprintf("%s %s %s snd.una=%d snd.nxt=%d snd.wnd=%d rcv.nxt=%d rcv.wnd=%d mss=%d rtt=%s rttvar=%s rto=%s %s cwnd=%d inflight=%d retrans=%d sent=%d received=%d",
+		info.State, info.Local, info.Foreign, info.SndUna, info.SndNxt, info.SndWnd, info.RcvNxt, info.RcvWnd, info.MSS,
+		info.RTT, info.RTTVar, info.RTO, info.CongestionControl, info.Cwnd, info.BytesInFlight,
+		info.Retransmits, info.BytesSent, info.BytesReceived)
+}
+
+// info returns the snapshot of the pcb. mutex must be held by the caller.
+func (pcb *pcb) info() Info {
+	return Info{
+		State:             pcb.state,
+		Local:             pcb.local,
+		Foreign:           pcb.foreign,
+		SndUna:            pcb.snd.una,
+		SndNxt:            pcb.snd.nxt,
+		SndWnd:            pcb.snd.wnd,
+		RcvNxt:            pcb.rcv.nxt,
+		RcvWnd:            pcb.rcv.wnd,
+		MSS:               pcb.mss,
+		RTT:               pcb.srtt,
+		RTTVar:            pcb.rttvar,
+		RTO:               pcb.currentRTO(),
+		CongestionControl: pcb.cc.Name(),
+		Cwnd:              pcb.cc.Window(),
+		BytesInFlight:     pcb.snd.nxt - pcb.snd.una,
+		Retransmits:       pcb.retransmits,
+		BytesSent:         pcb.bytesSent,
+		BytesReceived:     pcb.bytesReceived,
+	}
+}
+
+// Info returns the snapshot of the state of the pcb
+func (pcb *pcb) Info() Info {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	return pcb.info()
+}
+
+// Connections returns the snapshots of all of the pcbs of the protocol including the listening ones,
+// which are taken at the same time.
+func (p *Proto) Connections() []Info {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	infos := make([]Info, 0, len(p.pcbs))
+	for _, pcb := range p.pcbs {
+		infos = append(infos, pcb.info())
+	}
+	return infos
+}
@@ -0,0 +1,154 @@
+package tcp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"time"
+
+	"github.com/hedwig100/go-network/pkg/ip"
+)
+
+/*
+	Initial sequence number and SYN cookie
+*/
+
+const (
+	// the counter of the SYN cookie is incremented every this time,
+	// the cookie is valid while the counter is incremented less than maxCookieAge times
+	cookieInterval time.Duration = 64 * time.Second
+	maxCookieAge                 = 2
+
+	// lower bits of the cookie which have the index of the MSS
+	cookieBits = 24
+	cookieMask = 1<<cookieBits - 1
+)
+
+// MSS encoded in SYN cookie, the largest one not above the MSS of the foreign is chosen
+var cookieMSS = []uint16{536, 1300, 1440, 1460}
+
+// newSecret returns the random secret key used for ISN and SYN cookie
+func newSecret() [16]byte {
+	var secret [16]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		log.Printf("[E] TCP secret cannot be generated %s", err.Error())
+	}
+	return secret
+}
+
+// hash is the keyed hash of the connection, salt distinguishes the purposes
+func (p *Proto) hash(local Endpoint, foreign Endpoint, salt uint32) uint32 {
+	var buf [32]byte
+	copy(buf[:16], p.secret[:])
+	binary.BigEndian.PutUint32(buf[16:20], uint32(local.Addr))
+	binary.BigEndian.PutUint16(buf[20:22], local.Port)
+	binary.BigEndian.PutUint32(buf[22:26], uint32(foreign.Addr))
+	binary.BigEndian.PutUint16(buf[26:28], foreign.Port)
+	binary.BigEndian.PutUint32(buf[28:32], salt)
+	sum := sha256.Sum256(buf[:])
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// createISS returns ISN of the connection from local to foreign (RFC6528),
+// ISN = M + F(localip, localport, remoteip, remoteport, secretkey)
+// where M is the timer incremented every 4 microseconds.
+func (p *Proto) createISS(local Endpoint, foreign Endpoint) uint32 {
+	m := uint32(time.Now().UnixNano() / int64(4*time.Microsecond))
+	return m + p.hash(local, foreign, 0)
+}
+
+// synCookie returns ISN which encodes the connection in the SYN cookie,
+// the upper 8 bits is the counter and the lower 24 bits has the index of MSS.
+// irs is the initial sequence number of the foreign.
+func (p *Proto) synCookie(local Endpoint, foreign Endpoint, irs uint32, mss uint16) uint32 {
+	index := 0
+	for i, m := range cookieMSS {
+		if m <= mss {
+			index = i
+		}
+	}
+	count := uint32(time.Now().Unix() / int64(cookieInterval/time.Second))
+	return p.hash(local, foreign, 1) + irs + count<<cookieBits +
+		(p.hash(local, foreign, 2+count)+uint32(index))&cookieMask
+}
+
+// checkCookie returns MSS encoded in the SYN cookie iss,
+// and false if the cookie is invalid or too old.
+func (p *Proto) checkCookie(local Endpoint, foreign Endpoint, irs uint32, iss uint32) (uint16, bool) {
+	count := uint32(time.Now().Unix() / int64(cookieInterval/time.Second))
+	cookie := iss - p.hash(local, foreign, 1) - irs
+	diff := (count - cookie>>cookieBits) & (1<<(32-cookieBits) - 1)
+	if diff >= maxCookieAge {
+		return 0, false
+	}
+	index := (cookie - p.hash(local, foreign, 2+count-diff)) & cookieMask
+	if index >= uint32(len(cookieMSS)) {
+		return 0, false
+	}
+	return cookieMSS[index], true
+}
+
+// sendCookie replies SYN-ACK whose sequence number is the SYN cookie to the SYN from foreign,
+// the listening pcb remembers nothing about the connection. Only MSS option is sent
+// since the other options cannot be restored from the cookie. mutex must be held by the caller.
+func (pcb *pcb) sendCookie(local Endpoint, foreign Endpoint, seg segment) error {
+	advMSS := pcb.proto.mssFor(foreign.Addr)
+	iss := pcb.proto.synCookie(local, foreign, seg.seq, sendMSS(seg.opts.MSS, advMSS))
+	wnd := pcb.rcvBufSize
+	if wnd > 0xffff {
+		wnd = 0xffff
+	}
+	log.Printf("[D] TCP SYN cookie is sent: local=%s,foreign=%s", local, foreign)
+	return pcb.proto.txHandler(local, foreign, Options{MSS: advMSS}, []byte{}, iss, seg.seq+1, SYN|ACK, uint16(wnd), 0, ip.ECNNotECT)
+}
+
+// cookieAck makes the established connection from the ACK which returns the valid SYN cookie
+// and puts it into the accept queue. ok is false if the cookie is invalid,
+// nil is returned with the valid cookie if the queue is full.
+// mutex must be held by the caller.
+func (pcb *pcb) cookieAck(local Endpoint, foreign Endpoint, seg segment) (child *pcb, ok bool) {
+	mss, ok := pcb.proto.checkCookie(local, foreign, seg.seq-1, seg.ack-1)
+	if !ok {
+		return nil, false
+	}
+	if len(pcb.acceptQueue) >= pcb.backlog {
+		return nil, true
+	}
+
+	child = pcb.proto.newpcb(local)
+	child.foreign = foreign
+	child.timeout = pcb.timeout
+	child.rcvBufSize = pcb.rcvBufSize
+	child.rcvBufMax = pcb.rcvBufMax
+	child.release = true // deleted if it is closed before accepted
+
+	child.rcv.wnd = child.rcvBufSize
+	child.rcv.nxt = seg.seq
+	child.irs = seg.seq - 1
+	child.advMSS = pcb.proto.mssFor(foreign.Addr)
+	child.mss = sendMSS(mss, child.advMSS)
+	child.iss = seg.ack - 1
+	child.snd.una = seg.ack
+	child.snd.nxt = seg.ack
+	child.snd.wnd = seg.wnd
+	child.snd.maxWnd = seg.wnd
+	child.snd.wl1 = seg.seq
+	child.snd.wl2 = seg.ack
+	child.cc.Init(uint32(child.mss))
+	child.recover = child.iss
+	child.transition(PCBStateEstablished)
+	log.Printf("[D] TCP connection is established by SYN cookie: local=%s,foreign=%s", local, foreign)
+
+	pcb.acceptQueue = append(pcb.acceptQueue, child)
+	pcb.notify()
+	return child, true
+}
+
+// SetSYNCookies makes the listening pcb reply SYN cookies when the backlog is full,
+// so that the pcb keeps accepting the connections under SYN flood.
+func (pcb *pcb) SetSYNCookies(enable bool) {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	pcb.synCookies = enable
+}
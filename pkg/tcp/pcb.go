@@ -5,7 +5,7 @@ import (
 	"log"
 	"math"
 	"math/rand"
-	"sync"
+	"os"
 	"time"
 
 	"github.com/hedwig100/go-network/pkg/ip"
@@ -15,7 +15,11 @@ import (
 	Retransmition Queue entry
 */
 const (
-	maxRetxCount uint8 = 3
+	// the connection is aborted if the segment is not acknowledged after retransmitted this times
+	maxRetxCount uint8 = 8
+
+	// the number of the duplicate ACKs which triggers fast retransmit (RFC5681)
+	dupThresh = 3
 
 	triggerNo      uint8 = 0
 	triggerOpen    uint8 = 1
@@ -33,6 +37,24 @@ type retxEntry struct {
 	retxCount   uint8
 	errCh       chan error
 	triggerType uint8
+
+	// retransmitted by the timer or fast retransmit
+	retransmitted bool
+
+	// the foreign has received the segment out of order (SACK)
+	sacked bool
+}
+
+// end returns the sequence number next to the entry
+func (e retxEntry) end() uint32 {
+	end := e.seq + uint32(len(e.data))
+	if isSet(e.flag, SYN) {
+		end++
+	}
+	if isSet(e.flag, FIN) {
+		end++
+	}
+	return end
 }
 
 type rcvCmd struct {
@@ -41,6 +63,12 @@ type rcvCmd struct {
 	errCh chan error
 }
 
+// sndCmd is SEND call waiting for its data to be acknowledged
+type sndCmd struct {
+	end   uint32
+	errCh chan error
+}
+
 /*
 	TCP Protocol Control Block (Transmission Control Block)
 */
@@ -90,32 +118,45 @@ func (s PCBState) String() string {
 	}
 }
 
-func createISS() uint32 {
-	return rand.Uint32()
-}
-
 type snd struct {
 	una uint32
 	nxt uint32
-	wnd uint16
-	up  uint16
+	wnd uint32
+	up  uint32
 	wl1 uint32
 	wl2 uint32
+
+	// MAX.SND.WND, the largest window the foreign has advertised (RFC5961)
+	maxWnd uint32
 }
 
 type rcv struct {
 	nxt uint32
-	wnd uint16
-	up  uint16
+	wnd uint32
+	up  uint32
 }
 
 const (
-	bufferSize = math.MaxUint16
-)
+	// size of the send buffer which has the data not sent or not acknowledged yet
+	defaultSndBufferSize = 1 << 16
+
+	// size of the receive buffer which is advertised as the window at first,
+	// and the maximum size to which the buffer is tuned.
+	// The window larger than 64KB is advertised with window scale.
+	defaultRcvBufferSize = 1 << 16
+	defaultRcvBufferMax  = 1 << 22
+
+	// the receive buffer is tuned at this interval if RTT is not measured
+	autotuneInterval = 100 * time.Millisecond
 
-var (
-	mutex sync.Mutex
-	pcbs  []*pcb
+	// PAWS does not work for the connection idle for this period (RFC7323)
+	pawsIdle = 24 * 24 * time.Hour
+
+	// MSS which is assumed when the foreign does not send MSS option
+	defaultMSS = 536
+
+	// maximum number of the connections which are not accepted yet
+	defaultBacklog = 16
 )
 
 type pcb struct {
@@ -128,21 +169,260 @@ type pcb struct {
 	rcv
 	irs uint32
 
-	mss uint16
+	// mss is the maximum segment size to send,
+	// advMSS is the one advertised to the foreign
+	mss    uint16
+	advMSS uint16
 
 	// queue
-	rxQueue   [bufferSize]byte
-	rxLen     uint16
 	retxQueue []retxEntry
 	rcvCmd    rcvCmd
 
+	// receive buffer, rcvBufSize is the size advertised as the window which is tuned
+	// up to rcvBufMax according to how fast the user reads (autotuning).
+	// rcvCopied is the data read by the user since rcvTuneTime.
+	rxBuf       ringBuffer
+	rcvBufSize  uint32
+	rcvBufMax   uint32
+	rcvCopied   uint32
+	rcvTuneTime time.Time
+
+	// data which is not sent yet and SEND calls waiting for the acknowledgement,
+	// sndBufSize limits the data not sent or not acknowledged yet
+	txQueue    []byte
+	sndCmds    []sndCmd
+	sndBufSize int
+
+	// segments which arrive out of order
+	reassembly []oooSegment
+
+	// FIN is sent after the queued data is sent
+	finQueued bool
+	closeCh   chan error
+
 	timeout    time.Duration
 	lastTxTime time.Time
+
+	// window scale (RFC7323), the shift count of the window which is sent and received.
+	// wscaleOK is true if the option is offered or agreed.
+	wscaleOK bool
+	sndScale uint8
+	rcvScale uint8
+
+	// timestamps (RFC7323), tsRecent is the timestamp to be echoed
+	// and lastAckSent is ACK field of the last segment sent.
+	tsOK        bool
+	tsOffset    uint32
+	tsRecent    uint32
+	tsRecentAge time.Time
+	lastAckSent uint32
+
+	// selective acknowledgement (RFC2018,RFC6675), sackOK is true if the option is offered or agreed.
+	// sackRecent is the sequence number of the segment out of order received last,
+	// highSacked is the highest sequence number SACKed by the foreign and
+	// highRxt is the highest one retransmitted in the loss recovery.
+	sackOK     bool
+	sackRecent uint32
+	highSacked uint32
+	highRxt    uint32
+
+	// smoothed round-trip time, round-trip time variation and retransmission timeout
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+
+	// congestion control, the number of the duplicate ACKs and
+	// the highest sequence number sent when fast recovery started
+	cc         CongestionControl
+	dupAcks    int
+	recover    uint32
+	inRecovery bool
+
+	// the loss recovery after the retransmission timeout, which lasts until recover is acknowledged
+	lossRecovery bool
+
+	// statistics, the number of the segments retransmitted and
+	// the data octets sent (including retransmissions) and received in sequence
+	retransmits   uint64
+	bytesSent     uint64
+	bytesReceived uint64
+
+	// ECN (RFC3168), ecnEcho is set while ECE is sent and ecnCwr is set until CWR is sent.
+	// The window is not reduced again for ECE until ecnRecover is acknowledged.
+	ecnOK       bool
+	ecnEcho     bool
+	ecnCwr      bool
+	ecnReducing bool
+	ecnRecover  uint32
+
+	// delayed ACK (RFC1122), the number of the segments not acknowledged yet
+	// and the time when the ACK should be sent at the latest
+	ackPending int
+	ackDue     time.Time
+
+	// Nagle's algorithm is disabled
+	noDelay bool
+
+	// persist timer, the number of the window probes sent and the time to send the next one
+	persistCount uint8
+	persistNext  time.Time
+
+	// keepalive (RFC1122), lastRxTime is the time when the last segment is received,
+	// keepProbes is the number of the keepalive probes not answered.
+	keepAlive  KeepAliveConfig
+	lastRxTime time.Time
+	keepProbes int
+	keepNext   time.Time
+
+	// FIN has been received from the foreign
+	finReceived bool
+
+	// urgent data (RFC6093), SND.UP and RCV.UP are the sequence numbers following the urgent data.
+	// sndUrgent is set until the urgent data is acknowledged,
+	// rcvUrgent is set while the urgent data signaled by the foreign has not arrived.
+	sndUrgent bool
+	rcvUrgent bool
+
+	// the last octet of the urgent data is taken out of the stream into oob unless oobInline,
+	// urgMark is the length of the data before the urgent mark in the receive buffer.
+	oobInline  bool
+	oob        byte
+	oobValid   bool
+	urgMark    int
+	urgMarkSet bool
+
+	// the receiving side is shut down, the data arriving afterwards is discarded
+	readShut bool
+
+	// linger option, Close waits for FIN to be acknowledged at most linger if lingerOn.
+	// The connection is reset on Close if linger is zero.
+	lingerOn bool
+	linger   time.Duration
+
+	// error which closed the connection
+	err error
+
+	// the pcb is deleted when it becomes CLOSED (the user no longer has it)
+	release bool
+
+	// the FIN-WAIT-2 timeout of the pcb which the user no longer has starts at this time
+	finWait2Time time.Time
+
+	// closed when something happens to the pcb
+	event chan struct{}
+
+	// the timer in the timer wheel of the protocol, which expires at the earliest of the timeouts
+	timer wheelTimer
+
+	// listening pcb has the connections spawned by the incoming SYN,
+	// synQueue has ones in SYN-RECEIVED, acceptQueue has established ones not accepted yet.
+	backlog     int
+	synQueue    []*pcb
+	acceptQueue []*pcb
+
+	// SYN cookie is replied when the backlog is full
+	synCookies bool
+
+	// the listening pcb which spawned this pcb, nil after the connection is established
+	parent *pcb
+
+	// the key in the pcb table of the protocol
+	hashed *hashed
+
+	// protocol to which the pcb belongs
+	proto *Proto
 }
 
 func (pcb *pcb) transition(state PCBState) {
 	log.Printf("[I] local=%s, %s => %s", pcb.local, pcb.state, state)
+	prev := pcb.state
 	pcb.state = state
+	if state == PCBStateFINWait2 {
+		pcb.finWait2Time = time.Now()
+	}
+	pcb.proto.rehash(pcb)
+	pcb.rearm()
+	pcb.notify()
+
+	if pcb.parent != nil && prev == PCBStateSYNReceived {
+		pcb.parent.handoff(pcb)
+	}
+
+	if state == PCBStateClosed && pcb.release {
+		pcb.proto.remove(pcb)
+	}
+}
+
+// spawn creates the pcb for the incoming SYN from foreign to local on the listening pcb,
+// local has the address to which the SYN is sent even if the listening pcb is bound to the wildcard one.
+// nil is returned if the backlog is full. mutex must be held by the caller.
+func (pcb *pcb) spawn(local Endpoint, foreign Endpoint) *pcb {
+	if len(pcb.synQueue)+len(pcb.acceptQueue) >= pcb.backlog {
+		return nil
+	}
+	child := pcb.proto.newpcb(local)
+	child.foreign = foreign
+	child.timeout = pcb.timeout
+	child.rcvBufSize = pcb.rcvBufSize
+	child.rcvBufMax = pcb.rcvBufMax
+	child.parent = pcb
+	child.release = true // deleted if it is closed before accepted
+	pcb.synQueue = append(pcb.synQueue, child)
+	return child
+}
+
+// handoff moves the child which left SYN-RECEIVED from synQueue to acceptQueue.
+// The child is just forgotten if the connection is closed. mutex must be held by the caller.
+func (pcb *pcb) handoff(child *pcb) {
+	child.parent = nil
+	pcb.synQueue = removePCB(pcb.synQueue, child)
+	if child.state != PCBStateClosed {
+		pcb.acceptQueue = append(pcb.acceptQueue, child)
+		pcb.notify()
+	}
+}
+
+// abortChildren resets the connections which have not been accepted yet.
+// mutex must be held by the caller.
+func (pcb *pcb) abortChildren() {
+	n := len(pcb.synQueue)
+	children := append(pcb.synQueue[:n:n], pcb.acceptQueue...)
+	pcb.synQueue = nil
+	pcb.acceptQueue = nil
+	for _, child := range children {
+		child.parent = nil
+		child.release = true
+		if err := child.abort(); err != nil {
+			log.Printf("[E] TCP abort error %s", err.Error())
+		}
+		pcb.proto.remove(child)
+	}
+}
+
+func removePCB(pcbs []*pcb, pcb *pcb) []*pcb {
+	for i, t := range pcbs {
+		if t == pcb {
+			return append(pcbs[:i], pcbs[i+1:]...)
+		}
+	}
+	return pcbs
+}
+
+// wait returns the channel which is closed when something happens to the pcb.
+// mutex must be held by the caller.
+func (pcb *pcb) wait() chan struct{} {
+	if pcb.event == nil {
+		pcb.event = make(chan struct{})
+	}
+	return pcb.event
+}
+
+// notify wakes up the users waiting for the pcb.
+func (pcb *pcb) notify() {
+	if pcb.event != nil {
+		close(pcb.event)
+		pcb.event = nil
+	}
 }
 
 func (pcb *pcb) queueAdd(seq uint32, flag ControlFlag, data []byte, trigger uint8, errCh chan error) {
@@ -155,6 +435,7 @@ func (pcb *pcb) queueAdd(seq uint32, flag ControlFlag, data []byte, trigger uint
 		triggerType: trigger,
 		errCh:       errCh,
 	})
+	pcb.rearm()
 }
 
 func removeRetx(data []retxEntry, indexs []int) []retxEntry {
@@ -171,16 +452,41 @@ func removeRetx(data []retxEntry, indexs []int) []retxEntry {
 
 func (pcb *pcb) queueAck() {
 	var deleteIndex []int
+	var rtt time.Duration
 	for i, entry := range pcb.retxQueue {
-		if entry.seq < pcb.una {
+		if seqLE(entry.end(), pcb.una) {
 			deleteIndex = append(deleteIndex, i)
 			if entry.errCh != nil {
 				entry.errCh <- nil
 			}
-			calculateRTO(time.Since(entry.last))
+
+			// Karn's algorithm, the retransmitted segment is not measured
+			// because it is ambiguous which transmission is acknowledged.
+			if !entry.retransmitted {
+				rtt = time.Since(entry.first)
+			}
 		}
 	}
 	pcb.retxQueue = removeRetx(pcb.retxQueue, deleteIndex)
+	if rtt > 0 && !pcb.tsOK { // RTT is measured with timestamps if they are used
+		pcb.updateRTO(rtt)
+	}
+
+	// the retransmission timer restarts when new data is acknowledged
+	if len(deleteIndex) > 0 && len(pcb.retxQueue) > 0 {
+		pcb.retxQueue[0].last = time.Now()
+	}
+
+	// SEND calls whose data is all acknowledged
+	var n int
+	for _, cmd := range pcb.sndCmds {
+		if !seqLE(cmd.end, pcb.una) {
+			break
+		}
+		cmd.errCh <- nil
+		n++
+	}
+	pcb.sndCmds = pcb.sndCmds[n:]
 }
 
 func (pcb *pcb) queueFlush(msg string) {
@@ -191,6 +497,18 @@ func (pcb *pcb) queueFlush(msg string) {
 		}
 	}
 	pcb.retxQueue = nil
+
+	for _, cmd := range pcb.sndCmds {
+		cmd.errCh <- err
+	}
+	pcb.sndCmds = nil
+	pcb.txQueue = nil
+
+	if pcb.finQueued {
+		pcb.closeCh <- err
+		pcb.finQueued = false
+		pcb.closeCh = nil
+	}
 }
 
 func (pcb *pcb) signalCmd(trigger uint8) {
@@ -206,24 +524,246 @@ func (pcb *pcb) signalCmd(trigger uint8) {
 		}
 		pcb.retxQueue = removeRetx(pcb.retxQueue, deleteIndex)
 	case triggerReceive:
-		if pcb.rcvCmd.errCh != nil && pcb.rxLen > 0 {
-			dlen := copy(pcb.rcvCmd.data, pcb.rxQueue[:pcb.rxLen])
-			*pcb.rcvCmd.n = dlen
+		if pcb.rcvCmd.errCh != nil && pcb.rxBuf.Len() > 0 {
+			*pcb.rcvCmd.n = pcb.read(pcb.rcvCmd.data)
 			pcb.rcvCmd.errCh <- nil
-			if dlen == int(pcb.rxLen) {
-				pcb.rxLen = 0
-				pcb.rcv.wnd = bufferSize
-			} else {
-				copy(pcb.rxQueue[:], pcb.rxQueue[pcb.rxLen-uint16(dlen):])
-				pcb.rxLen -= uint16(dlen)
-				pcb.rcv.wnd += uint16(dlen)
-			}
 			pcb.rcvCmd = rcvCmd{}
 		}
 	default:
 	}
 }
 
+// read moves the received data to buf and returns its length,
+// it stops at the urgent mark so that the user can know where it is.
+func (pcb *pcb) read(buf []byte) int {
+	if pcb.urgMarkSet && pcb.urgMark > 0 && len(buf) > pcb.urgMark {
+		buf = buf[:pcb.urgMark]
+	}
+	dlen := pcb.rxBuf.read(buf)
+	if pcb.urgMarkSet {
+		pcb.urgMark -= dlen
+		pcb.urgMarkSet = pcb.urgMark >= 0
+	}
+
+	prev := pcb.rcv.wnd
+	pcb.rcv.wnd += uint32(dlen)
+	pcb.autotune(uint32(dlen))
+	pcb.windowUpdate(prev)
+	return dlen
+}
+
+// autotune grows the receive buffer if the user reads more than half of it in RTT,
+// so that the window does not limit the throughput. The buffer never shrinks
+// because the window advertised must not be shrunk.
+func (pcb *pcb) autotune(copied uint32) {
+	now := time.Now()
+	if pcb.rcvTuneTime.IsZero() {
+		pcb.rcvTuneTime = now
+	}
+	pcb.rcvCopied += copied
+
+	interval := pcb.srtt
+	if interval == 0 {
+		interval = autotuneInterval
+	}
+	if now.Sub(pcb.rcvTuneTime) < interval {
+		return
+	}
+
+	// the window cannot be larger than the one expressed with window scale
+	max := pcb.rcvBufMax
+	if limit := uint32(math.MaxUint16) << pcb.rcvScale; max > limit {
+		max = limit
+	}
+	if size := min32(2*pcb.rcvCopied, max); size > pcb.rcvBufSize {
+		log.Printf("[D] TCP receive buffer local=%s,size=%d => %d", pcb.local, pcb.rcvBufSize, size)
+		pcb.rcv.wnd += size - pcb.rcvBufSize
+		pcb.rcvBufSize = size
+	}
+	pcb.rcvCopied = 0
+	pcb.rcvTuneTime = now
+}
+
+// windowUpdate tells the foreign that the window is opened after the user reads the data.
+// To avoid silly window syndrome, the update is sent only when the window which was
+// smaller than MSS becomes at least MSS (RFC1122).
+func (pcb *pcb) windowUpdate(prev uint32) {
+	switch pcb.state {
+	case PCBStateEstablished, PCBStateFINWait1, PCBStateFINWait2:
+	default:
+		return
+	}
+	mss := uint32(pcb.advMSS)
+	if prev >= mss || pcb.rcv.wnd < mss {
+		return
+	}
+	if err := TxHelperTCP(pcb, ACK, []byte{}, 0, nil); err != nil {
+		log.Printf("[E] TCP window update error %s", err.Error())
+	}
+}
+
+/*
+	Reassembly Queue
+*/
+
+// oooSegment is the segment text which arrives out of order
+type oooSegment struct {
+	seq  uint32
+	data []byte
+
+	// FIN follows the data
+	fin bool
+}
+
+func (s oooSegment) end() uint32 {
+	return s.seq + uint32(len(s.data))
+}
+
+// insertSegment puts seg into the queue sorted by the sequence number,
+// the segments overlapping or adjacent to seg are merged into one.
+func insertSegment(queue []oooSegment, seg oooSegment) []oooSegment {
+	var ret []oooSegment
+	for _, s := range queue {
+		if seqLT(s.end(), seg.seq) || seqLT(seg.end(), s.seq) {
+			ret = append(ret, s)
+			continue
+		}
+		seg = mergeSegment(seg, s)
+	}
+
+	i := 0
+	for i < len(ret) && seqLT(ret[i].seq, seg.seq) {
+		i++
+	}
+	ret = append(ret, oooSegment{})
+	copy(ret[i+1:], ret[i:])
+	ret[i] = seg
+	return ret
+}
+
+// mergeSegment returns the segment which covers both a and b
+func mergeSegment(a oooSegment, b oooSegment) oooSegment {
+	start := a.seq
+	if seqLT(b.seq, start) {
+		start = b.seq
+	}
+	end := a.end()
+	if seqLT(end, b.end()) {
+		end = b.end()
+	}
+	data := make([]byte, end-start)
+	copy(data[a.seq-start:], a.data)
+	copy(data[b.seq-start:], b.data)
+	return oooSegment{
+		seq:  start,
+		data: data,
+		fin:  a.fin || b.fin,
+	}
+}
+
+// inWindow returns true if seq is in the receive window
+func (pcb *pcb) inWindow(seq uint32) bool {
+	return seqLE(pcb.rcv.nxt, seq) && seqLT(seq, pcb.rcv.nxt+pcb.rcv.wnd)
+}
+
+// receiveText puts the segment text into the receive queue after trimming off the part
+// outside of the window. The text out of order is held in the reassembly queue until
+// the gap is filled. It returns true if FIN is now in sequence.
+func (pcb *pcb) receiveText(seq uint32, data []byte, fin bool) bool {
+
+	// trim off the part which has been already received
+	if seqLT(seq, pcb.rcv.nxt) {
+		skip := pcb.rcv.nxt - seq
+		if skip > uint32(len(data)) {
+			return false
+		}
+		data = data[skip:]
+		seq = pcb.rcv.nxt
+	}
+
+	// trim off the part beyond the window
+	right := pcb.rcv.nxt + pcb.rcv.wnd
+	if seqLE(right, seq) {
+		return false
+	}
+	if seqLT(right, seq+uint32(len(data))) {
+		data = data[:right-seq]
+		fin = false
+	}
+
+	// out of order
+	if seq != pcb.rcv.nxt {
+		pcb.sackRecent = seq
+		pcb.reassembly = insertSegment(pcb.reassembly, oooSegment{
+			seq:  seq,
+			data: append([]byte{}, data...),
+			fin:  fin,
+		})
+		return false
+	}
+
+	pcb.deliver(data)
+
+	// the segments which become in sequence
+	for len(pcb.reassembly) > 0 && !fin {
+		s := pcb.reassembly[0]
+		if seqLT(pcb.rcv.nxt, s.seq) {
+			break
+		}
+		pcb.reassembly = pcb.reassembly[1:]
+		if seqLT(s.end(), pcb.rcv.nxt) {
+			continue
+		}
+		pcb.deliver(s.data[pcb.rcv.nxt-s.seq:])
+		fin = s.fin
+	}
+	if fin {
+		pcb.reassembly = nil
+	}
+	return fin
+}
+
+// sackBlocks returns at most max blocks of the reassembly queue to be reported to the foreign,
+// the first block contains the segment received last (RFC2018).
+func (pcb *pcb) sackBlocks(max int) []SACKBlock {
+	var blocks []SACKBlock
+	for _, s := range pcb.reassembly {
+		if len(s.data) == 0 {
+			continue
+		}
+		b := SACKBlock{Left: s.seq, Right: s.end()}
+		if seqLE(b.Left, pcb.sackRecent) && seqLT(pcb.sackRecent, b.Right) {
+			blocks = append([]SACKBlock{b}, blocks...)
+		} else {
+			blocks = append(blocks, b)
+		}
+	}
+	if len(blocks) > max {
+		blocks = blocks[:max]
+	}
+	return blocks
+}
+
+// deliver puts the data in sequence into the receive queue,
+// the data is only acknowledged if the receiving side is shut down.
+func (pcb *pcb) deliver(data []byte) {
+	pcb.bytesReceived += uint64(len(data))
+	if pcb.readShut {
+		pcb.rcv.nxt += uint32(len(data))
+		return
+	}
+	if pcb.rcvUrgent {
+		// the last octet of the urgent data is in data
+		if off := pcb.rcv.up - 1 - pcb.rcv.nxt; off < uint32(len(data)) {
+			pcb.deliverUrgent(data, int(off))
+			return
+		}
+	}
+	pcb.rxBuf.write(data)
+	pcb.rcv.nxt += uint32(len(data))
+	pcb.rcv.wnd -= uint32(len(data))
+}
+
 func (pcb *pcb) signalErr(msg string) {
 	pcb.queueFlush(msg)
 	err := fmt.Errorf(msg)
@@ -231,50 +771,75 @@ func (pcb *pcb) signalErr(msg string) {
 		pcb.rcvCmd.errCh <- err
 	}
 	pcb.rcvCmd = rcvCmd{}
+	pcb.err = err
+	pcb.notify()
 }
 
 // Newpcb returns *TCBpcb if there is no *pcb whose address is not the same as local
-func Newpcb(local Endpoint) (*pcb, error) {
-	// check if the same local address has not been used
-	mutex.Lock()
-	defer mutex.Unlock()
-	for _, t := range pcbs {
+func (p *Proto) Newpcb(local Endpoint) (*pcb, error) {
+	// check if the same local address has not been used,
+	// the zero port is assigned the ephemeral one on the active open
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if local.Port == 0 {
+		return p.newpcb(local), nil
+	}
+	for _, t := range p.pcbs {
 		if t.local == local {
 			return nil, fmt.Errorf("the same local address(%s) is already used", local)
 		}
 	}
+	return p.newpcb(local), nil
+}
 
+// newpcb adds new pcb to the table without checking the local address.
+// mutex must be held by the caller.
+func (p *Proto) newpcb(local Endpoint) *pcb {
 	pcb := &pcb{
-		state: PCBStateClosed,
-		local: local,
+		state:      PCBStateClosed,
+		local:      local,
+		sndBufSize: defaultSndBufferSize,
+		rcvBufSize: defaultRcvBufferSize,
+		rcvBufMax:  defaultRcvBufferMax,
+		cc:         &NewReno{},
+		proto:      p,
 	}
-	pcbs = append(pcbs, pcb)
-	return pcb, nil
+	p.pcbs = append(p.pcbs, pcb)
+	return pcb
 }
 
-func Deletepcb(pcb *pcb) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	for i, t := range pcbs {
+func (p *Proto) Deletepcb(pcb *pcb) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.remove(pcb) {
+		return fmt.Errorf("pcb not found, and cannot be deleted")
+	}
+	return nil
+}
+
+// remove removes the pcb from the table.
+// mutex must be held by the caller.
+func (p *Proto) remove(pcb *pcb) bool {
+	for i, t := range p.pcbs {
 		if t == pcb {
-			pcbs = append(pcbs[:i], pcbs[i+1:]...)
-			return nil
+			p.unhash(pcb)
+			p.wheel.remove(&pcb.timer)
+			p.pcbs = append(p.pcbs[:i], p.pcbs[i+1:]...)
+			return true
 		}
 	}
-	return fmt.Errorf("pcb not found, and cannot be deleted")
+	return false
 }
 
 func (pcb *pcb) Open(errCh chan error, foreign Endpoint, isActive bool, timeout time.Duration) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
 
 	switch pcb.state {
 	case PCBStateClosed:
 		// passive open
 		if !isActive {
-			log.Printf("[D] passive open: local=%s,waiting for connection...", pcb.local)
-			pcb.timeout = timeout
-			pcb.transition(PCBStateListen)
+			pcb.listen(timeout)
 			errCh <- nil
 			return
 		}
@@ -283,11 +848,19 @@ func (pcb *pcb) Open(errCh chan error, foreign Endpoint, isActive bool, timeout
 			errCh <- fmt.Errorf("foreign socket unspecified")
 			return
 		}
+		if err := pcb.autobind(foreign); err != nil {
+			errCh <- err
+			return
+		}
 
 		pcb.timeout = timeout
 		pcb.foreign = foreign
+		pcb.rcv.wnd = pcb.rcvBufSize
+		pcb.advMSS = pcb.proto.mssFor(foreign.Addr)
+		pcb.mss = sendMSS(0, pcb.advMSS)
+		pcb.offerOptions()
 
-		iss := createISS()
+		iss := pcb.proto.createISS(pcb.local, pcb.foreign)
 		pcb.iss = iss
 		pcb.snd.una = iss
 		pcb.snd.nxt = iss + 1
@@ -318,11 +891,20 @@ func (pcb *pcb) Open(errCh chan error, foreign Endpoint, isActive bool, timeout
 			errCh <- fmt.Errorf("foreign socket unspecified")
 			return
 		}
+		if err := pcb.autobind(foreign); err != nil {
+			errCh <- err
+			return
+		}
+		pcb.abortChildren()
 
 		pcb.timeout = timeout
 		pcb.foreign = foreign
+		pcb.rcv.wnd = pcb.rcvBufSize
+		pcb.advMSS = pcb.proto.mssFor(foreign.Addr)
+		pcb.mss = sendMSS(0, pcb.advMSS)
+		pcb.offerOptions()
 
-		iss := createISS()
+		iss := pcb.proto.createISS(pcb.local, pcb.foreign)
 		pcb.iss = iss
 		pcb.snd.una = iss
 		pcb.snd.nxt = iss + 1
@@ -345,9 +927,59 @@ func (pcb *pcb) Open(errCh chan error, foreign Endpoint, isActive bool, timeout
 	}
 }
 
+// listen moves the pcb to LISTEN state (passive open).
+// mutex must be held by the caller.
+func (pcb *pcb) listen(timeout time.Duration) {
+	log.Printf("[D] passive open: local=%s,waiting for connection...", pcb.local)
+	pcb.timeout = timeout
+	pcb.foreign = Endpoint{}
+	pcb.finReceived = false
+	pcb.err = nil
+	if pcb.backlog == 0 {
+		pcb.backlog = defaultBacklog
+	}
+	pcb.transition(PCBStateListen)
+}
+
+// SetBacklog sets the maximum number of the connections which wait for Accept
+// (including ones in SYN-RECEIVED). It should be called before the passive open.
+func (pcb *pcb) SetBacklog(backlog int) error {
+	if backlog <= 0 {
+		return fmt.Errorf("backlog must be positive")
+	}
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	pcb.backlog = backlog
+	return nil
+}
+
+// Accept waits for the connection to be established on the listening pcb and returns it.
+// The returned pcb should be closed and deleted by the user like the one made by Newpcb.
+func (pcb *pcb) Accept() (*pcb, error) {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+
+	for {
+		if pcb.state != PCBStateListen {
+			return nil, fmt.Errorf("connection does not exist")
+		}
+		if len(pcb.acceptQueue) > 0 {
+			child := pcb.acceptQueue[0]
+			pcb.acceptQueue = pcb.acceptQueue[1:]
+			child.release = false
+			return child, nil
+		}
+
+		event := pcb.wait()
+		pcb.proto.mutex.Unlock()
+		<-event
+		pcb.proto.mutex.Lock()
+	}
+}
+
 func (pcb *pcb) Send(errCh chan error, data []byte) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
 
 	switch pcb.state {
 	case PCBStateClosed:
@@ -357,30 +989,579 @@ func (pcb *pcb) Send(errCh chan error, data []byte) {
 	case PCBStateSYNSent, PCBStateSYNReceived:
 		errCh <- fmt.Errorf("connection does not exist")
 	case PCBStateEstablished, PCBStateCloseWait:
-		if len(data) > int(pcb.snd.wnd) {
-			errCh <- fmt.Errorf("insufficient resources")
+		if pcb.finQueued {
+			errCh <- fmt.Errorf("connection closing")
+			return
 		}
 
-		var err error
-		for i := 0; i < 3; i++ { // try to send data at most three time ( because of ARP cache specification of this package).
-			if err = TxHelperTCP(pcb, ACK, data, triggerSend, errCh); err != nil {
-				log.Printf("[E] TCP SEND call error %s", err.Error())
-				time.Sleep(20 * time.Millisecond)
-			} else {
-				pcb.snd.nxt += uint32(len(data))
+		// the data is copied into the send buffer and sent by output,
+		// errCh is notified after the foreign acknowledges all of the data.
+		// If the buffer is full (e.g. the foreign advertises the zero window),
+		// SEND call blocks until the buffered data is acknowledged.
+		for {
+			n, err := pcb.write(data, false)
+			if err != nil {
+				errCh <- err
 				return
 			}
+			data = data[n:]
+			if len(data) == 0 {
+				break
+			}
+
+			event := pcb.wait()
+			pcb.proto.mutex.Unlock()
+			<-event
+			pcb.proto.mutex.Lock()
 		}
-		errCh <- err
+		pcb.sndCmds = append(pcb.sndCmds, sndCmd{
+			end:   pcb.snd.nxt + uint32(len(pcb.txQueue)),
+			errCh: errCh,
+		})
 
 	default:
 		errCh <- fmt.Errorf("connection closing")
 	}
 }
 
+// Write copies the data into the send buffer, which is sent as the window and
+// the congestion window allow. It blocks while the buffer is full and returns
+// the length of the data accepted when an error occurs or deadline is closed.
+func (pcb *pcb) Write(data []byte, deadline <-chan struct{}) (int, error) {
+	return pcb.writeWait(data, false, deadline)
+}
+
+// writeWait copies the data into the send buffer blocking while the buffer is full,
+// the data is sent as the urgent data if urgent is true.
+func (pcb *pcb) writeWait(data []byte, urgent bool, deadline <-chan struct{}) (int, error) {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+
+	var written int
+	for {
+		n, err := pcb.write(data[written:], urgent)
+		written += n
+		if err != nil || written == len(data) {
+			return written, err
+		}
+
+		event := pcb.wait()
+		pcb.proto.mutex.Unlock()
+		select {
+		case <-event:
+			pcb.proto.mutex.Lock()
+		case <-deadline:
+			pcb.proto.mutex.Lock()
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// write copies the data into the send buffer as much as the space allows
+// and returns its length. If urgent is true, the urgent pointer is moved to the end of the data.
+// mutex must be held by the caller.
+func (pcb *pcb) write(data []byte, urgent bool) (int, error) {
+	switch pcb.state {
+	case PCBStateEstablished, PCBStateCloseWait:
+	case PCBStateClosed:
+		if pcb.err != nil {
+			return 0, pcb.err
+		}
+		return 0, fmt.Errorf("connection does not exist")
+	case PCBStateListen, PCBStateSYNSent, PCBStateSYNReceived:
+		return 0, fmt.Errorf("connection does not exist")
+	default:
+		return 0, fmt.Errorf("connection closing")
+	}
+	if pcb.finQueued {
+		return 0, fmt.Errorf("connection closing")
+	}
+
+	n := pcb.sndBufSize - pcb.sndBuffered()
+	if n <= 0 {
+		return 0, nil
+	}
+	if n > len(data) {
+		n = len(data)
+	}
+	pcb.txQueue = append(pcb.txQueue, data[:n]...)
+	if urgent {
+		pcb.snd.up = pcb.snd.nxt + uint32(len(pcb.txQueue))
+		pcb.sndUrgent = true
+	}
+	if err := pcb.output(); err != nil {
+		log.Printf("[E] TCP output error %s", err.Error())
+	}
+	return n, nil
+}
+
+// SetReceiveBuffer sets the maximum size of the receive buffer.
+// The window already advertised is not shrunk even if it is larger than the size.
+func (pcb *pcb) SetReceiveBuffer(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("buffer size must be positive")
+	}
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	pcb.rcvBufMax = uint32(size)
+	switch pcb.state {
+	case PCBStateClosed, PCBStateListen:
+		// the buffer is not used yet
+		pcb.rcvBufSize = min32(defaultRcvBufferSize, pcb.rcvBufMax)
+	}
+	return nil
+}
+
+// sndBuffered returns the length of the data in the send buffer
+func (pcb *pcb) sndBuffered() int {
+	return len(pcb.txQueue) + int(pcb.snd.nxt-pcb.snd.una)
+}
+
+// SetSendBuffer sets the size of the send buffer. The data already buffered
+// is not discarded even if it is larger than the size.
+func (pcb *pcb) SetSendBuffer(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("buffer size must be positive")
+	}
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	pcb.sndBufSize = size
+	pcb.notify()
+	return nil
+}
+
+// SetCongestionControl sets the congestion control algorithm of the connection,
+// NewReno is used by default. If the connection has been already established,
+// the algorithm starts from the initial state.
+func (pcb *pcb) SetCongestionControl(cc CongestionControl) {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	pcb.cc = cc
+	switch pcb.state {
+	case PCBStateListen, PCBStateSYNSent, PCBStateSYNReceived, PCBStateClosed:
+	default:
+		pcb.cc.Init(uint32(pcb.mss))
+	}
+}
+
+// SetKeepAlive configures keepalive of the connection, which is disabled by default.
+// Zero value of the duration or the count means the default one.
+func (pcb *pcb) SetKeepAlive(config KeepAliveConfig) error {
+	if config.Idle < 0 || config.Interval < 0 || config.Count < 0 {
+		return fmt.Errorf("keepalive parameter must not be negative")
+	}
+	if config.Idle == 0 {
+		config.Idle = defaultKeepAliveIdle
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultKeepAliveInterval
+	}
+	if config.Count == 0 {
+		config.Count = defaultKeepAliveCount
+	}
+
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	pcb.keepAlive = config
+	pcb.keepProbes = 0
+	pcb.keepNext = time.Time{}
+	pcb.rearm()
+	return nil
+}
+
+// SetNoDelay disables Nagle's algorithm if noDelay is true, which is enabled by default.
+func (pcb *pcb) SetNoDelay(noDelay bool) {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	pcb.noDelay = noDelay
+	if err := pcb.output(); err != nil {
+		log.Printf("[E] TCP output error %s", err.Error())
+	}
+}
+
+// updateWindow updates the send window with the acceptable ACK.
+// Note that SND.WND is an offset from SND.UNA, that SND.WL1
+// records the sequence number of the last segment used to update
+// SND.WND, and that SND.WL2 records the acknowledgment number of
+// the last segment used to update SND.WND.  The check here
+// prevents using old segments to update the window.
+func (pcb *pcb) updateWindow(seg segment) {
+	if seqLT(pcb.snd.wl1, seg.seq) || (pcb.snd.wl1 == seg.seq && seqLE(pcb.snd.wl2, seg.ack)) {
+		pcb.snd.wnd = seg.wnd
+		pcb.snd.wl1 = seg.seq
+		pcb.snd.wl2 = seg.ack
+	}
+	if pcb.snd.maxWnd < pcb.snd.wnd {
+		pcb.snd.maxWnd = pcb.snd.wnd
+	}
+}
+
+// newAck updates the congestion window when new data is acknowledged.
+// Partial ACK in fast recovery makes the next segment retransmitted (RFC6582),
+// or the holes are retransmitted by output if SACK is used.
+func (pcb *pcb) newAck(acked uint32) {
+	pcb.dupAcks = 0
+	if pcb.lossRecovery && seqLE(pcb.recover, pcb.snd.una) {
+		pcb.lossRecovery = false
+	}
+	if !pcb.inRecovery {
+		pcb.cc.OnAck(acked, pcb.srtt)
+		return
+	}
+
+	if seqLE(pcb.recover, pcb.snd.una) {
+		pcb.inRecovery = false
+		pcb.cc.OnRecoveryExit(pcb.snd.nxt - pcb.snd.una)
+		log.Printf("[D] fast recovery finished local=%s,cwnd=%d", pcb.local, pcb.cc.Window())
+		return
+	}
+	// with SACK the window is not deflated, pipe limits the data sent (RFC6675)
+	if !pcb.sackOK {
+		pcb.retransmit()
+		pcb.cc.OnPartialAck(acked)
+	}
+}
+
+// dupAck counts the duplicate ACK, the third one triggers fast retransmit.
+// The window is inflated by the duplicate ACKs only without SACK,
+// with SACK the segments which have left the network are excluded from pipe instead.
+func (pcb *pcb) dupAck() {
+	pcb.dupAcks++
+	if pcb.inRecovery {
+		if !pcb.sackOK {
+			pcb.cc.OnDupAck()
+		}
+		return
+	}
+
+	// a new fast recovery does not start until the data sent in the last one is acknowledged
+	if pcb.dupAcks == dupThresh && seqLE(pcb.recover, pcb.snd.una) {
+		pcb.inRecovery = true
+		pcb.recover = pcb.snd.nxt
+		pcb.highRxt = pcb.snd.una
+		pcb.cc.OnFastRetransmit(pcb.snd.nxt-pcb.snd.una, pcb.sackOK)
+		log.Printf("[D] fast retransmit local=%s,seq=%d,cwnd=%d", pcb.local, pcb.snd.una, pcb.cc.Window())
+		pcb.retransmit()
+	}
+}
+
+// retransmit sends the oldest unacknowledged segment again
+func (pcb *pcb) retransmit() {
+	if len(pcb.retxQueue) == 0 {
+		return
+	}
+	pcb.resend(&pcb.retxQueue[0])
+}
+
+// resend sends the segment in the retransmission queue again
+func (pcb *pcb) resend(entry *retxEntry) {
+	pcb.retransmits++
+	entry.retransmitted = true
+	entry.last = time.Now()
+	if seqLT(pcb.highRxt, entry.end()) {
+		pcb.highRxt = entry.end()
+	}
+	if err := pcb.transmit(entry.seq, entry.flag, entry.data); err != nil {
+		log.Printf("[E] : retransmit error %s", err)
+	}
+}
+
+/*
+	SACK scoreboard (RFC6675)
+*/
+
+// updateScoreboard marks the segments in the retransmission queue covered by the SACK blocks.
+// The blocks outside of the unacknowledged data (including D-SACK) are ignored.
+func (pcb *pcb) updateScoreboard(blocks []SACKBlock) {
+	if seqLT(pcb.highSacked, pcb.snd.una) {
+		pcb.highSacked = pcb.snd.una
+	}
+	for _, b := range blocks {
+		if seqLT(b.Left, pcb.snd.una) || seqLT(pcb.snd.nxt, b.Right) || !seqLT(b.Left, b.Right) {
+			continue
+		}
+		for i := range pcb.retxQueue {
+			entry := &pcb.retxQueue[i]
+			if seqLE(b.Left, entry.seq) && seqLE(entry.end(), b.Right) {
+				entry.sacked = true
+			}
+		}
+		if seqLT(pcb.highSacked, b.Right) {
+			pcb.highSacked = b.Right
+		}
+	}
+}
+
+// isLost returns true if the segment is considered lost in the loss recovery.
+// In fast recovery the segment is lost if DupThresh segments or more than (DupThresh-1)*MSS bytes
+// above it are SACKed (RFC6675), after the retransmission timeout all of the segments not SACKed are lost.
+func (pcb *pcb) isLost(entry *retxEntry) bool {
+	if entry.sacked {
+		return false
+	}
+	if pcb.lossRecovery {
+		return seqLT(entry.seq, pcb.recover)
+	}
+	if !pcb.inRecovery || seqLT(pcb.highSacked, entry.end()) {
+		return false
+	}
+	var segs int
+	var bytes uint32
+	for i := range pcb.retxQueue {
+		e := &pcb.retxQueue[i]
+		if e.sacked && seqLE(entry.end(), e.seq) {
+			segs++
+			bytes += e.end() - e.seq
+		}
+	}
+	return segs >= dupThresh || bytes > (dupThresh-1)*uint32(pcb.mss)
+}
+
+// nextHole returns the index of the lost segment which is not retransmitted yet, -1 if none.
+func (pcb *pcb) nextHole() int {
+	for i := range pcb.retxQueue {
+		entry := &pcb.retxQueue[i]
+		if seqLE(pcb.highRxt, entry.seq) && pcb.isLost(entry) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pipe estimates the amount of the data in the network,
+// the segments SACKed and the lost ones not retransmitted yet are excluded.
+func (pcb *pcb) pipe() uint32 {
+	var pipe uint32
+	for i := range pcb.retxQueue {
+		entry := &pcb.retxQueue[i]
+		if entry.sacked || (seqLE(pcb.highRxt, entry.seq) && pcb.isLost(entry)) {
+			continue
+		}
+		pipe += entry.end() - entry.seq
+	}
+	return pipe
+}
+
+// sendHoles retransmits the lost segments in the loss recovery as much as the congestion window allows,
+// so that the multiple losses in one window are recovered in one RTT. Fast recovery uses it only with SACK,
+// the recovery after the retransmission timeout uses it with or without SACK.
+func (pcb *pcb) sendHoles() {
+	if !pcb.lossRecovery && !(pcb.sackOK && pcb.inRecovery) {
+		return
+	}
+	for pcb.pipe() < pcb.cc.Window() {
+		i := pcb.nextHole()
+		if i < 0 {
+			return
+		}
+		pcb.resend(&pcb.retxQueue[i])
+	}
+}
+
+// output sends the queued data as much as the window of the foreign allows,
+// each segment is at most MSS. After all the data is sent, the queued FIN is sent.
+// The data which cannot be sent is sent by the next call.
+// mutex must be held by the caller.
+func (pcb *pcb) output() error {
+	defer pcb.rearm()
+
+	// the lost segments have priority over new data
+	pcb.sendHoles()
+
+	for len(pcb.txQueue) > 0 {
+		wnd := min32(pcb.snd.wnd, pcb.cc.Window())
+		inflight := pcb.snd.nxt - pcb.snd.una
+		if pcb.sackOK && pcb.inRecovery {
+			// the window is not inflated in SACK recovery, pipe is compared with it (RFC6675)
+			inflight = pcb.pipe()
+		}
+		if inflight >= wnd {
+			return nil
+		}
+
+		// MSS includes the options (RFC6691)
+		maxSeg := int(pcb.mss) - pcb.optionLen()
+		n := len(pcb.txQueue)
+		if n > maxSeg {
+			n = maxSeg
+		}
+		if n > int(wnd-inflight) {
+			n = int(wnd - inflight)
+		}
+
+		// Nagle's algorithm (RFC1122), the small segment waits while data is unacknowledged
+		// so that the small SEND calls are coalesced. The data before FIN and the urgent data are not delayed.
+		urgent := pcb.sndUrgent && seqLT(pcb.snd.nxt, pcb.snd.up)
+		if n < maxSeg && !pcb.noDelay && !pcb.finQueued && !urgent && pcb.snd.nxt != pcb.snd.una {
+			return nil
+		}
+		data := make([]byte, n)
+		copy(data, pcb.txQueue)
+
+		flag := ACK
+		if n == len(pcb.txQueue) {
+			flag |= PSH
+		}
+
+		// the data which cannot be sent (e.g. the address is not resolved yet) is left in the queue
+		// and sent by the timer, the mutex is not held while waiting for it
+		if err := TxHelperTCP(pcb, flag, data, triggerSend, nil); err != nil {
+			return err
+		}
+		pcb.snd.nxt += uint32(n)
+		pcb.txQueue = pcb.txQueue[n:]
+	}
+
+	if pcb.finQueued {
+		if err := TxHelperTCP(pcb, ACK|FIN, []byte{}, triggerClose, pcb.closeCh); err != nil {
+			return err
+		}
+		pcb.snd.nxt++
+		pcb.finQueued = false
+		pcb.closeCh = nil
+		if pcb.state == PCBStateCloseWait {
+			pcb.transition(PCBStateLastACK)
+		}
+		log.Printf("[D] active close: local=%s,foreign=%s,closing...", pcb.local, pcb.foreign)
+	}
+	return nil
+}
+
+// offerOptions makes the pcb offer window scale, timestamps, SACK and ECN in SYN (active open)
+func (pcb *pcb) offerOptions() {
+	pcb.wscaleOK = true
+	pcb.sndScale = 0
+	pcb.rcvScale = windowShift(pcb.rcvBufMax)
+	pcb.tsOK = true
+	pcb.tsOffset = rand.Uint32()
+	pcb.sackOK = true
+	pcb.ecnOK = pcb.proto.ecn
+}
+
+// agreeOptions sets window scale, timestamps and SACK according to the options in SYN from the foreign.
+// The options are used only when both sides send them.
+func (pcb *pcb) agreeOptions(opts Options) {
+	if pcb.wscaleOK && opts.HasWScale {
+		pcb.sndScale = opts.WScale
+		if pcb.sndScale > maxWScale {
+			pcb.sndScale = maxWScale
+		}
+	} else {
+		pcb.wscaleOK = false
+		pcb.sndScale = 0
+		pcb.rcvScale = 0
+	}
+
+	if pcb.tsOK && opts.HasTimestamp {
+		pcb.tsRecent = opts.TSVal
+		pcb.tsRecentAge = time.Now()
+	} else {
+		pcb.tsOK = false
+	}
+
+	pcb.sackOK = pcb.sackOK && opts.SACKPermitted
+}
+
+// segmentOptions returns the options sent in the segment with flag
+func (pcb *pcb) segmentOptions(flag ControlFlag) Options {
+	var opts Options
+	if isSet(flag, SYN) {
+		opts.MSS = pcb.advMSS
+		if pcb.wscaleOK {
+			opts.HasWScale = true
+			opts.WScale = pcb.rcvScale
+		}
+		opts.SACKPermitted = pcb.sackOK
+	}
+	if pcb.tsOK {
+		opts.HasTimestamp = true
+		opts.TSVal = pcb.tsNow()
+		if isSet(flag, ACK) {
+			opts.TSEcr = pcb.tsRecent
+		}
+	}
+
+	// SACK blocks are put in the space left (NOP,NOP,kind and length take 4 bytes)
+	if pcb.sackOK && isSet(flag, ACK) && !isSet(flag, SYN) && len(pcb.reassembly) > 0 {
+		space := optionLenMax - len(opts.encode()) - 4
+		opts.SACK = pcb.sackBlocks(space / optionLenSACKBlock)
+	}
+	return opts
+}
+
+// optionLen returns the length of the options in the data segment
+func (pcb *pcb) optionLen() int {
+	return len(pcb.segmentOptions(ACK).encode())
+}
+
+// windowShift returns the shift count to advertise the window of size
+func windowShift(size uint32) uint8 {
+	var shift uint8
+	for size>>shift > math.MaxUint16 && shift < maxWScale {
+		shift++
+	}
+	return shift
+}
+
+// tsNow returns the timestamp clock of the pcb, whose unit is 1ms
+func (pcb *pcb) tsNow() uint32 {
+	return uint32(time.Now().UnixNano()/int64(time.Millisecond)) + pcb.tsOffset
+}
+
+// paws returns false if the segment is an old duplicate (Protection Against Wrapped Sequences)
+func (pcb *pcb) paws(seg segment, flag ControlFlag) bool {
+	if !pcb.tsOK || !seg.opts.HasTimestamp || isSet(flag, RST) {
+		return true
+	}
+	if !seqLT(seg.opts.TSVal, pcb.tsRecent) {
+		return true
+	}
+	// the timestamp is invalidated if the connection is idle for long time
+	if time.Since(pcb.tsRecentAge) > pawsIdle {
+		return true
+	}
+	return false
+}
+
+// updateTSRecent records the timestamp of the segment to be echoed (RFC7323)
+func (pcb *pcb) updateTSRecent(seg segment) {
+	if !pcb.tsOK || !seg.opts.HasTimestamp {
+		return
+	}
+	if !seqLT(seg.opts.TSVal, pcb.tsRecent) && seqLE(seg.seq, pcb.lastAckSent) {
+		pcb.tsRecent = seg.opts.TSVal
+		pcb.tsRecentAge = time.Now()
+	}
+}
+
+// sendMSS returns MSS used for sending from the MSS option of the foreign and the advertised one
+func sendMSS(optMSS uint16, advMSS uint16) uint16 {
+	mss := uint16(defaultMSS)
+	if optMSS > 0 {
+		mss = optMSS
+	}
+	if advMSS > 0 && advMSS < mss {
+		mss = advMSS
+	}
+	return mss
+}
+
+// mssFor returns MSS advertised to dst, which is calculated from the MTU of the device to dst.
+func (p *Proto) mssFor(dst ip.Addr) uint16 {
+	route, err := p.ip.LookupTable(dst)
+	if err != nil {
+		return defaultMSS
+	}
+	mtu := int(route.Iface.Dev().MTU())
+	if mtu-ip.HeaderSizeMin-HeaderSizeMin < defaultMSS {
+		return defaultMSS
+	}
+	return uint16(mtu - ip.HeaderSizeMin - HeaderSizeMin)
+}
+
 func (pcb *pcb) Receive(errCh chan error, buf []byte, n *int) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
 
 	switch pcb.state {
 	case PCBStateClosed:
@@ -400,7 +1581,9 @@ func (pcb *pcb) Receive(errCh chan error, buf []byte, n *int) {
 			errCh: errCh,
 		}
 		pcb.signalCmd(triggerReceive)
-	case PCBStateCloseWait:
+	case PCBStateCloseWait, PCBStateClosing, PCBStateLastACK, PCBStateTimeWait:
+		// Since the remote side has already sent FIN, RECEIVEs must be
+		// satisfied by text already on hand, but not yet delivered to the user.
 		if pcb.rcvCmd.errCh != nil {
 			errCh <- fmt.Errorf("RECEIVE was already called and data haven't come yet")
 			return
@@ -423,14 +1606,15 @@ func (pcb *pcb) Receive(errCh chan error, buf []byte, n *int) {
 }
 
 func (pcb *pcb) Close(errCh chan error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
 
 	switch pcb.state {
 	case PCBStateClosed:
 		errCh <- fmt.Errorf("connection does not exist")
 	case PCBStateListen:
 		// Any outstanding RECEIVEs are returned with "error:  closing" responses.
+		pcb.abortChildren()
 		pcb.signalErr("closing")
 		pcb.transition(PCBStateClosed)
 		errCh <- nil
@@ -461,6 +1645,12 @@ func (pcb *pcb) Close(errCh chan error) {
 		// Queue this until all preceding SENDs have been segmentized, then
 		// form a FIN segment and send it.  In any case, enter FIN-WAIT-1
 		// state.
+		if len(pcb.txQueue) > 0 {
+			pcb.finQueued = true
+			pcb.closeCh = errCh
+			pcb.transition(PCBStateFINWait1)
+			return
+		}
 		var err error
 		for i := 0; i < 3; i++ { // try to send FIN at most three time ( because of ARP cache specification of this package).
 			if err = TxHelperTCP(pcb, ACK|FIN, []byte{}, triggerClose, errCh); err != nil {
@@ -480,6 +1670,15 @@ func (pcb *pcb) Close(errCh chan error) {
 	case PCBStateCloseWait:
 		// Queue this request until all preceding SENDs have been
 		// segmentized; then send a FIN segment, enter CLOSING state.
+		if pcb.finQueued {
+			errCh <- fmt.Errorf("connection closing")
+			return
+		}
+		if len(pcb.txQueue) > 0 {
+			pcb.finQueued = true
+			pcb.closeCh = errCh
+			return
+		}
 		var err error
 		for i := 0; i < 3; i++ { // try to send FIN at most three time ( because of ARP cache specification of this package).
 			if err = TxHelperTCP(pcb, ACK|FIN, []byte{}, triggerClose, errCh); err != nil {
@@ -498,16 +1697,78 @@ func (pcb *pcb) Close(errCh chan error) {
 	}
 }
 
+// CloseRead shuts down the receiving side of the connection. The data not read yet is discarded
+// and the data arriving afterwards is acknowledged and discarded, so the foreign can finish sending.
+func (pcb *pcb) CloseRead() error {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+
+	switch pcb.state {
+	case PCBStateClosed, PCBStateListen:
+		return fmt.Errorf("connection does not exist")
+	}
+	if pcb.readShut {
+		return nil
+	}
+	pcb.readShut = true
+	pcb.urgMarkSet = false
+	if pcb.rxBuf.Len() > 0 {
+		pcb.read(make([]byte, pcb.rxBuf.Len()))
+	}
+	if pcb.rcvCmd.errCh != nil {
+		pcb.rcvCmd.errCh <- fmt.Errorf("connection closing")
+		pcb.rcvCmd = rcvCmd{}
+	}
+	pcb.notify()
+	return nil
+}
+
+// SetLinger sets how Close behaves when the data is not acknowledged yet like SO_LINGER.
+// If sec < 0 (default), Close returns at once and the data and FIN are sent in the background.
+// If sec == 0, Close discards the data and resets the connection.
+// If sec > 0, Close waits for FIN to be acknowledged and resets the connection after sec seconds.
+func (pcb *pcb) SetLinger(sec int) {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	pcb.lingerOn = sec >= 0
+	pcb.linger = time.Duration(sec) * time.Second
+}
+
+// closing reports whether CLOSE has been called, FIN is sent or queued.
+// mutex must be held by the caller.
+func (pcb *pcb) closing() bool {
+	switch pcb.state {
+	case PCBStateFINWait1, PCBStateFINWait2, PCBStateClosing, PCBStateLastACK, PCBStateTimeWait:
+		return true
+	}
+	return pcb.finQueued
+}
+
+// finAcked reports whether FIN sent by CLOSE has been acknowledged or the connection is closed.
+// mutex must be held by the caller.
+func (pcb *pcb) finAcked() bool {
+	switch pcb.state {
+	case PCBStateFINWait2, PCBStateTimeWait, PCBStateClosed:
+		return true
+	}
+	return false
+}
+
 func (pcb *pcb) Abort() error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	return pcb.abort()
+}
 
+// abort is ABORT call, mutex must be held by the caller.
+func (pcb *pcb) abort() error {
 	switch pcb.state {
 	case PCBStateClosed:
 		return fmt.Errorf("connection does not exist")
 	case PCBStateListen:
 		// Any outstanding RECEIVEs should be returned with "error:
 		// connection reset" responses
+		pcb.abortChildren()
 		pcb.signalErr("connection reset")
 		pcb.transition(PCBStateClosed)
 		return nil
@@ -523,7 +1784,7 @@ func (pcb *pcb) Abort() error {
 		// RST formed above) or retransmission should be flushed
 		pcb.signalErr("connection reset")
 		pcb.transition(PCBStateClosed)
-		return TxHandler(pcb.local, pcb.foreign, []byte{}, pcb.snd.nxt, 0, RST, 0, 0)
+		return pcb.proto.TxHandler(pcb.local, pcb.foreign, []byte{}, pcb.snd.nxt, 0, RST, 0, 0)
 	default:
 		pcb.transition(PCBStateClosed)
 		return nil
@@ -0,0 +1,854 @@
+package tcp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hedwig100/go-network/pkg/ip"
+)
+
+func peekAll(r *ringBuffer) string {
+	buf := make([]byte, r.Len())
+	r.peek(buf)
+	return string(buf)
+}
+
+func TestReassembly(t *testing.T) {
+	pcb := &pcb{}
+	pcb.rcv.nxt = 0xfffffff0 // across the wraparound
+	pcb.rcv.wnd = defaultRcvBufferSize
+	base := pcb.rcv.nxt
+
+	text := []byte("abcdefghijklmnopqrstuvwxyz")
+
+	// segments arrive out of order and overlap each other
+	if fin := pcb.receiveText(base+10, text[10:15], false); fin {
+		t.Error("FIN is in sequence")
+	}
+	if fin := pcb.receiveText(base+20, text[20:], true); fin {
+		t.Error("FIN is in sequence")
+	}
+	if fin := pcb.receiveText(base+12, text[12:18], false); fin {
+		t.Error("FIN is in sequence")
+	}
+	if len(pcb.reassembly) != 2 {
+		t.Errorf("reassembly queue has %d segments, want 2", len(pcb.reassembly))
+	}
+	if pcb.rxBuf.Len() != 0 || pcb.rcv.nxt != base {
+		t.Errorf("out of order data is delivered len=%d", pcb.rxBuf.Len())
+	}
+
+	// the first gap is filled
+	if fin := pcb.receiveText(base, text[:10], false); fin {
+		t.Error("FIN is in sequence")
+	}
+	if received := peekAll(&pcb.rxBuf); received != string(text[:18]) {
+		t.Errorf("received %q, want %q", received, text[:18])
+	}
+
+	// the last gap is filled with the retransmission which partially has been received
+	if fin := pcb.receiveText(base+15, text[15:21], false); !fin {
+		t.Error("FIN is not in sequence")
+	}
+	if received := peekAll(&pcb.rxBuf); received != string(text) {
+		t.Errorf("received %q, want %q", received, text)
+	}
+	if pcb.rcv.nxt != base+uint32(len(text)) {
+		t.Errorf("rcv.nxt is %d, want %d", pcb.rcv.nxt, base+uint32(len(text)))
+	}
+	if pcb.rcv.wnd != defaultRcvBufferSize-uint32(len(text)) {
+		t.Errorf("rcv.wnd is %d, want %d", pcb.rcv.wnd, defaultRcvBufferSize-len(text))
+	}
+	if len(pcb.reassembly) != 0 {
+		t.Errorf("reassembly queue has %d segments, want 0", len(pcb.reassembly))
+	}
+}
+
+func TestReassemblyWindow(t *testing.T) {
+	pcb := &pcb{}
+	pcb.rcv.nxt = 100
+	pcb.rcv.wnd = 10
+
+	// the part beyond the window is trimmed off with FIN
+	if fin := pcb.receiveText(105, []byte("0123456789"), true); fin {
+		t.Error("FIN beyond the window is accepted")
+	}
+	if len(pcb.reassembly) != 1 || len(pcb.reassembly[0].data) != 5 || pcb.reassembly[0].fin {
+		t.Errorf("reassembly queue is %v", pcb.reassembly)
+	}
+}
+
+func TestRTO(t *testing.T) {
+	pcb := &pcb{cc: &NewReno{}}
+
+	entry := &retxEntry{}
+	if rto := pcb.retxTimeout(entry); rto != initialRTO {
+		t.Errorf("initial RTO is %s, want %s", rto, initialRTO)
+	}
+	if rto := pcb.info().RTO; rto != initialRTO {
+		t.Errorf("RTO in info is %s, want %s", rto, initialRTO)
+	}
+
+	// first measurement
+	pcb.updateRTO(2 * time.Second)
+	if pcb.srtt != 2*time.Second || pcb.rttvar != time.Second || pcb.rto != 6*time.Second {
+		t.Errorf("srtt=%s,rttvar=%s,rto=%s", pcb.srtt, pcb.rttvar, pcb.rto)
+	}
+
+	// subsequent measurement
+	pcb.updateRTO(time.Second)
+	if pcb.srtt != 1875*time.Millisecond || pcb.rttvar != 1000*time.Millisecond || pcb.rto != 5875*time.Millisecond {
+		t.Errorf("srtt=%s,rttvar=%s,rto=%s", pcb.srtt, pcb.rttvar, pcb.rto)
+	}
+
+	// exponential backoff
+	entry.retxCount = 2
+	if rto := pcb.retxTimeout(entry); rto != 4*pcb.rto {
+		t.Errorf("RTO after backoff is %s, want %s", rto, 4*pcb.rto)
+	}
+	entry.retxCount = 5
+	if rto := pcb.retxTimeout(entry); rto != ubound {
+		t.Errorf("RTO after backoff is %s, want %s", rto, ubound)
+	}
+}
+
+func TestKarn(t *testing.T) {
+	pcb := &pcb{}
+	pcb.snd.una = 100
+
+	// the retransmitted segment is not measured
+	pcb.retxQueue = []retxEntry{{
+		seq:           90,
+		data:          make([]byte, 10),
+		first:         time.Now().Add(-30 * time.Second),
+		retransmitted: true,
+	}}
+	pcb.queueAck()
+	if len(pcb.retxQueue) != 0 {
+		t.Error("acknowledged segment remains")
+	}
+	if pcb.srtt != 0 {
+		t.Errorf("retransmitted segment is measured, srtt=%s", pcb.srtt)
+	}
+
+	// partially acknowledged segment remains
+	pcb.retxQueue = []retxEntry{{
+		seq:   95,
+		data:  make([]byte, 10),
+		first: time.Now(),
+	}}
+	pcb.queueAck()
+	if len(pcb.retxQueue) != 1 {
+		t.Error("partially acknowledged segment is removed")
+	}
+}
+
+func TestNewReno(t *testing.T) {
+	const mss = 1000
+	cc := &NewReno{}
+	cc.Init(mss)
+	if cc.Window() != 4*mss {
+		t.Errorf("initial window is %d, want %d", cc.Window(), 4*mss)
+	}
+
+	// slow start
+	cc.OnAck(mss, time.Second)
+	if cc.Window() != 5*mss {
+		t.Errorf("window is %d, want %d", cc.Window(), 5*mss)
+	}
+
+	// fast retransmit and fast recovery
+	cc.OnFastRetransmit(10*mss, false)
+	if cc.Window() != 8*mss {
+		t.Errorf("window is %d, want %d", cc.Window(), 8*mss)
+	}
+	cc.OnDupAck()
+	if cc.Window() != 9*mss {
+		t.Errorf("window is %d, want %d", cc.Window(), 9*mss)
+	}
+	cc.OnPartialAck(2 * mss)
+	if cc.Window() != 8*mss {
+		t.Errorf("window is %d, want %d", cc.Window(), 8*mss)
+	}
+	cc.OnRecoveryExit(6 * mss)
+	if cc.Window() != 5*mss {
+		t.Errorf("window is %d, want %d", cc.Window(), 5*mss)
+	}
+
+	// congestion avoidance
+	cc.OnAck(mss, time.Second)
+	if cc.Window() != 5*mss+mss/5 {
+		t.Errorf("window is %d, want %d", cc.Window(), 5*mss+mss/5)
+	}
+
+	// timeout
+	cc.OnTimeout(8 * mss)
+	if cc.Window() != mss || cc.ssthresh != 4*mss {
+		t.Errorf("window is %d, ssthresh is %d", cc.Window(), cc.ssthresh)
+	}
+
+	// the window is not inflated with SACK
+	cc.OnFastRetransmit(10*mss, true)
+	if cc.Window() != 5*mss {
+		t.Errorf("window is %d, want %d", cc.Window(), 5*mss)
+	}
+}
+
+func TestCubic(t *testing.T) {
+	const mss = 1000
+	cc := &Cubic{}
+	cc.Init(mss)
+
+	// the window is reduced by beta
+	cc.cwnd = 100 * mss
+	cc.OnFastRetransmit(100*mss, false)
+	if cc.ssthresh != 70*mss || cc.wMax != 100 {
+		t.Errorf("ssthresh is %d, wMax is %f", cc.ssthresh, cc.wMax)
+	}
+	cc.OnRecoveryExit(70 * mss)
+	if cc.Window() != 70*mss {
+		t.Errorf("window is %d, want %d", cc.Window(), 70*mss)
+	}
+
+	// the window grows toward wMax in the concave region and does not exceed it soon
+	for i := 0; i < 70; i++ {
+		cc.OnAck(mss, 10*time.Millisecond)
+	}
+	if cc.Window() <= 70*mss || cc.Window() > 100*mss {
+		t.Errorf("window is %d", cc.Window())
+	}
+
+	// fast convergence
+	cc.cwnd = 80 * mss
+	cc.OnFastRetransmit(80*mss, false)
+	if cc.wMax != 80*(1+cubicBeta)/2 {
+		t.Errorf("wMax is %f, want %f", cc.wMax, 80*(1+cubicBeta)/2)
+	}
+}
+
+func TestWindowScale(t *testing.T) {
+	if shift := windowShift(65535); shift != 0 {
+		t.Errorf("shift is %d, want 0", shift)
+	}
+	if shift := windowShift(1 << 18); shift != 3 {
+		t.Errorf("shift is %d, want 3", shift)
+	}
+
+	// the option is ignored if the foreign does not send it
+	pcb := &pcb{proto: &Proto{}}
+	pcb.offerOptions()
+	pcb.agreeOptions(Options{HasTimestamp: true, TSVal: 100})
+	if pcb.wscaleOK || pcb.rcvScale != 0 || !pcb.tsOK || pcb.tsRecent != 100 {
+		t.Errorf("wscaleOK=%t,rcvScale=%d,tsOK=%t,tsRecent=%d", pcb.wscaleOK, pcb.rcvScale, pcb.tsOK, pcb.tsRecent)
+	}
+}
+
+func TestPAWS(t *testing.T) {
+	pcb := &pcb{tsOK: true, tsRecent: 100, tsRecentAge: time.Now()}
+	pcb.rcv.nxt = 1000
+	pcb.lastAckSent = 1000
+
+	if !pcb.paws(segment{seq: 1000, opts: Options{HasTimestamp: true, TSVal: 101}}, ACK) {
+		t.Error("new segment is rejected")
+	}
+	if pcb.paws(segment{seq: 1000, opts: Options{HasTimestamp: true, TSVal: 99}}, ACK) {
+		t.Error("old duplicate segment is accepted")
+	}
+	if !pcb.paws(segment{seq: 1000, opts: Options{HasTimestamp: true, TSVal: 99}}, RST) {
+		t.Error("RST is rejected")
+	}
+
+	pcb.updateTSRecent(segment{seq: 1000, opts: Options{HasTimestamp: true, TSVal: 120}})
+	if pcb.tsRecent != 120 {
+		t.Errorf("tsRecent is %d, want 120", pcb.tsRecent)
+	}
+}
+
+func TestSACKBlocks(t *testing.T) {
+	pcb := &pcb{sackOK: true}
+	pcb.rcv.nxt = 100
+	pcb.rcv.wnd = defaultRcvBufferSize
+
+	pcb.receiveText(110, make([]byte, 10), false)
+	pcb.receiveText(130, make([]byte, 10), false)
+	pcb.receiveText(150, make([]byte, 10), false)
+	pcb.receiveText(120, make([]byte, 5), false)
+
+	// the block received last is the first
+	want := []SACKBlock{{110, 125}, {130, 140}, {150, 160}}
+	if blocks := pcb.sackBlocks(4); !reflect.DeepEqual(blocks, want) {
+		t.Errorf("SACK blocks are %v, want %v", blocks, want)
+	}
+	if blocks := pcb.sackBlocks(2); len(blocks) != 2 {
+		t.Errorf("SACK blocks are %v", blocks)
+	}
+
+	// with timestamps at most three blocks are sent
+	pcb.tsOK = true
+	pcb.receiveText(170, make([]byte, 10), false)
+	opts := pcb.segmentOptions(ACK)
+	if len(opts.SACK) != 3 || opts.SACK[0] != (SACKBlock{170, 180}) {
+		t.Errorf("SACK blocks are %v", opts.SACK)
+	}
+	if len(opts.encode()) > optionLenMax {
+		t.Errorf("options are too long, len=%d", len(opts.encode()))
+	}
+}
+
+func TestSACKScoreboard(t *testing.T) {
+	pcb := &pcb{sackOK: true, mss: 10, cc: &NewReno{}}
+	pcb.cc.Init(10)
+	pcb.snd.una = 0
+	pcb.snd.nxt = 100
+	for seq := uint32(0); seq < 100; seq += 10 {
+		pcb.retxQueue = append(pcb.retxQueue, retxEntry{seq: seq, data: make([]byte, 10)})
+	}
+
+	// the segments [0,10),[30,40) and [60,100) are not SACKed
+	pcb.updateScoreboard([]SACKBlock{{10, 30}, {40, 60}})
+	pcb.inRecovery = true
+	pcb.highRxt = pcb.snd.una
+	if pcb.highSacked != 60 {
+		t.Errorf("highSacked is %d, want 60", pcb.highSacked)
+	}
+
+	// only [0,10) has DupThresh segments SACKed above it
+	if pipe := pcb.pipe(); pipe != 50 {
+		t.Errorf("pipe is %d, want 50", pipe)
+	}
+	if i := pcb.nextHole(); i != 0 {
+		t.Errorf("next hole is %d, want 0", i)
+	}
+
+	// the third segment SACKed above [30,40) makes it lost
+	pcb.updateScoreboard([]SACKBlock{{70, 80}})
+	var holes []uint32
+	for i := pcb.nextHole(); i >= 0; i = pcb.nextHole() {
+		holes = append(holes, pcb.retxQueue[i].seq)
+		pcb.highRxt = pcb.retxQueue[i].end()
+	}
+	if !reflect.DeepEqual(holes, []uint32{0, 30}) {
+		t.Errorf("holes are %v, want [0 30]", holes)
+	}
+
+	// after the timeout all of the segments not SACKed are lost
+	pcb.inRecovery = false
+	pcb.lossRecovery = true
+	pcb.recover = pcb.snd.nxt
+	pcb.highRxt = pcb.snd.una
+	if i := pcb.nextHole(); i != 0 {
+		t.Errorf("next hole is %d, want 0", i)
+	}
+	if pipe := pcb.pipe(); pipe != 0 {
+		t.Errorf("pipe is %d, want 0", pipe)
+	}
+
+	// the block beyond SND.NXT is ignored
+	pcb.updateScoreboard([]SACKBlock{{90, 110}})
+	if pcb.retxQueue[9].sacked {
+		t.Error("invalid SACK block is accepted")
+	}
+}
+
+func TestRTORecovery(t *testing.T) {
+	pcb := &pcb{mss: 10, cc: &NewReno{}}
+	pcb.cc.Init(10)
+	pcb.snd.una = 0
+	pcb.snd.nxt = 50
+	for seq := uint32(0); seq < 50; seq += 10 {
+		pcb.retxQueue = append(pcb.retxQueue, retxEntry{seq: seq, data: make([]byte, 10)})
+	}
+
+	// after the timeout every segment is lost without SACK, the oldest one is retransmitted first
+	pcb.cc.OnTimeout(pcb.snd.nxt - pcb.snd.una)
+	pcb.lossRecovery = true
+	pcb.recover = pcb.snd.nxt
+	pcb.highRxt = pcb.snd.una
+	if i := pcb.nextHole(); i != 0 {
+		t.Errorf("next hole is %d, want 0", i)
+	}
+	pcb.retxQueue[0].retransmitted = true
+	pcb.highRxt = pcb.retxQueue[0].end()
+	if pipe := pcb.pipe(); pipe != pcb.cc.Window() {
+		t.Errorf("pipe is %d, window is %d", pipe, pcb.cc.Window())
+	}
+
+	// the next segment is retransmitted when the retransmission is acknowledged, without another timeout
+	pcb.snd.una = 10
+	pcb.una = 10
+	pcb.queueAck()
+	pcb.newAck(10)
+	if i := pcb.nextHole(); i != 0 || pcb.retxQueue[i].seq != 10 {
+		t.Errorf("next hole is %d", i)
+	}
+	if pipe := pcb.pipe(); pipe >= pcb.cc.Window() {
+		t.Errorf("pipe is %d, window is %d", pipe, pcb.cc.Window())
+	}
+
+	// the recovery finishes when the data sent before the timeout is acknowledged
+	pcb.snd.una = 50
+	pcb.newAck(40)
+	if pcb.lossRecovery {
+		t.Error("loss recovery does not finish")
+	}
+}
+
+func TestNagle(t *testing.T) {
+	pcb := &pcb{mss: 1000, cc: &NewReno{}}
+	pcb.cc.Init(1000)
+	pcb.snd.wnd = 10000
+	pcb.snd.una = 0
+	pcb.snd.nxt = 10
+
+	// the small segment is not sent while the data is unacknowledged
+	pcb.txQueue = make([]byte, 100)
+	if err := pcb.output(); err != nil {
+		t.Error(err)
+	}
+	if len(pcb.txQueue) != 100 || pcb.snd.nxt != 10 {
+		t.Errorf("small segment is sent, queued=%d,snd.nxt=%d", len(pcb.txQueue), pcb.snd.nxt)
+	}
+}
+
+func TestDelayedAck(t *testing.T) {
+	pcb := &pcb{state: PCBStateClosed, proto: &Proto{}}
+
+	// the first segment is not acknowledged immediately
+	if err := pcb.delayAck(); err != nil {
+		t.Error(err)
+	}
+	if pcb.ackPending != 1 || pcb.ackDue.IsZero() {
+		t.Errorf("ackPending=%d,ackDue=%s", pcb.ackPending, pcb.ackDue)
+	}
+}
+
+func TestSendBuffer(t *testing.T) {
+	pcb := &pcb{state: PCBStateEstablished, sndBufSize: 100, cc: &NewReno{}}
+	pcb.cc.Init(1000)
+
+	// the foreign advertises the zero window, the data remains in the buffer
+	if n, err := pcb.write(make([]byte, 60), false); n != 60 || err != nil {
+		t.Errorf("n=%d,err=%v", n, err)
+	}
+	if n, err := pcb.write(make([]byte, 60), false); n != 40 || err != nil {
+		t.Errorf("partial write n=%d,err=%v", n, err)
+	}
+	if n, err := pcb.write(make([]byte, 60), false); n != 0 || err != nil {
+		t.Errorf("buffer is full but n=%d,err=%v", n, err)
+	}
+
+	pcb.finQueued = true
+	if _, err := pcb.write(make([]byte, 60), false); err == nil {
+		t.Error("data is written after CLOSE")
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	var r ringBuffer
+	if r.buf != nil {
+		t.Error("buffer is allocated before written")
+	}
+
+	// the data across the end of the buffer
+	r.write(make([]byte, ringBufferMinSize-10))
+	r.read(make([]byte, ringBufferMinSize-20))
+	r.write([]byte("0123456789abcdefghij"))
+	if len(r.buf) != ringBufferMinSize {
+		t.Errorf("buffer grows to %d", len(r.buf))
+	}
+	buf := make([]byte, 10)
+	r.read(buf)
+	if got := peekAll(&r); got != "0123456789abcdefghij" {
+		t.Errorf("data is %q", got)
+	}
+
+	// the buffer grows keeping the data
+	r.write(make([]byte, ringBufferMinSize))
+	if len(r.buf) != 2*ringBufferMinSize || r.Len() != ringBufferMinSize+20 {
+		t.Errorf("size=%d,len=%d", len(r.buf), r.Len())
+	}
+	buf = make([]byte, 20)
+	if n := r.read(buf); n != 20 || string(buf) != "0123456789abcdefghij" {
+		t.Errorf("read %q", buf[:n])
+	}
+}
+
+func TestAutotune(t *testing.T) {
+	pcb := &pcb{rcvBufSize: defaultRcvBufferSize, rcvBufMax: defaultRcvBufferMax, rcvScale: windowShift(defaultRcvBufferMax)}
+	pcb.rcv.wnd = defaultRcvBufferSize
+
+	// the user reads the whole buffer in RTT
+	pcb.srtt = 10 * time.Millisecond
+	pcb.autotune(0)
+	time.Sleep(pcb.srtt)
+	pcb.autotune(defaultRcvBufferSize)
+	if pcb.rcvBufSize != 2*defaultRcvBufferSize || pcb.rcv.wnd != 2*defaultRcvBufferSize {
+		t.Errorf("rcvBufSize=%d,rcv.wnd=%d", pcb.rcvBufSize, pcb.rcv.wnd)
+	}
+
+	// the buffer does not exceed the maximum
+	time.Sleep(pcb.srtt)
+	pcb.autotune(defaultRcvBufferMax)
+	if pcb.rcvBufSize != defaultRcvBufferMax {
+		t.Errorf("rcvBufSize=%d", pcb.rcvBufSize)
+	}
+
+	// the slow reader does not shrink the buffer
+	time.Sleep(pcb.srtt)
+	pcb.autotune(1)
+	if pcb.rcvBufSize != defaultRcvBufferMax {
+		t.Errorf("rcvBufSize=%d", pcb.rcvBufSize)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	p := &Proto{
+		conns:     make(map[connKey]*pcb),
+		listeners: make(map[Endpoint]*pcb),
+	}
+	local, _ := Str2Endpoint("192.0.2.2:80")
+	any, _ := Str2Endpoint("0.0.0.0:80")
+	foreign, _ := Str2Endpoint("192.0.2.1:49152")
+	other, _ := Str2Endpoint("192.0.2.1:49153")
+
+	wildcard := p.newpcb(any)
+	wildcard.transition(PCBStateListen)
+	if pcb := p.lookup(local, foreign); pcb != wildcard {
+		t.Error("wildcard listener is not found")
+	}
+
+	listener := p.newpcb(local)
+	listener.transition(PCBStateListen)
+	conn := p.newpcb(local)
+	conn.foreign = foreign
+	conn.transition(PCBStateEstablished)
+
+	// exact match first, then the listener bound to the address
+	if pcb := p.lookup(local, foreign); pcb != conn {
+		t.Error("connection is not found")
+	}
+	if pcb := p.lookup(local, other); pcb != listener {
+		t.Error("listener is not found")
+	}
+
+	// the pcb removed is not found
+	p.remove(conn)
+	p.remove(listener)
+	if pcb := p.lookup(local, foreign); pcb != wildcard {
+		t.Error("removed pcb is found")
+	}
+	wildcard.transition(PCBStateClosed)
+	if pcb := p.lookup(local, foreign); pcb != nil {
+		t.Error("closed listener is found")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := rateLimiter{rate: 10, burst: 5}
+	now := time.Now()
+
+	// burst is allowed at once
+	for i := 0; i < 5; i++ {
+		if !l.allow(now) {
+			t.Fatalf("event %d is not allowed", i)
+		}
+	}
+	if l.allow(now) {
+		t.Error("event over the burst is allowed")
+	}
+
+	// a token is added every 1/rate second
+	now = now.Add(100 * time.Millisecond)
+	if !l.allow(now) {
+		t.Error("event after the refill is not allowed")
+	}
+	if l.allow(now) {
+		t.Error("event over the refill is allowed")
+	}
+
+	// tokens do not exceed the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		l.allow(now)
+	}
+	if l.allow(now) {
+		t.Error("event over the burst is allowed after the long idle")
+	}
+}
+
+func TestChallengeAck(t *testing.T) {
+	// the segments are not transmitted actually because of no route
+	p := &Proto{
+		conns:          make(map[connKey]*pcb),
+		listeners:      make(map[Endpoint]*pcb),
+		challengeLimit: rateLimiter{rate: 1, burst: 10},
+		ip:             &ip.IProto{},
+	}
+	local, _ := Str2Endpoint("192.0.2.2:80")
+	foreign, _ := Str2Endpoint("192.0.2.1:49152")
+	pcb := p.newpcb(local)
+	pcb.foreign = foreign
+	pcb.cc = &NewReno{}
+	pcb.cc.Init(1000)
+	pcb.rcv.nxt = 1000
+	pcb.rcv.wnd = 1000
+	pcb.snd.una = 5000
+	pcb.snd.nxt = 6000
+	pcb.snd.wnd = 1000
+	pcb.snd.maxWnd = 1000
+	pcb.transition(PCBStateEstablished)
+
+	challenges := func() int {
+		return 10 - int(p.challengeLimit.tokens)
+	}
+
+	// RST in the window but not at RCV.NXT
+	segmentArrives(pcb, segment{seq: 1500, ack: 5000}, RST|ACK, nil, 0, local, foreign)
+	if pcb.state != PCBStateEstablished || challenges() != 1 {
+		t.Errorf("state=%s,challenges=%d after RST in the window", pcb.state, challenges())
+	}
+
+	// SYN in the window
+	segmentArrives(pcb, segment{seq: 1000, len: 1}, SYN, nil, 0, local, foreign)
+	if pcb.state != PCBStateEstablished || challenges() != 2 {
+		t.Errorf("state=%s,challenges=%d after SYN", pcb.state, challenges())
+	}
+
+	// ACK of the data not sent yet and too old ACK
+	segmentArrives(pcb, segment{seq: 1000, ack: 6001, wnd: 1000}, ACK, nil, 0, local, foreign)
+	segmentArrives(pcb, segment{seq: 1000, ack: 3999, wnd: 1000}, ACK, nil, 0, local, foreign)
+	if pcb.snd.una != 5000 || challenges() != 4 {
+		t.Errorf("snd.una=%d,challenges=%d after invalid ACK", pcb.snd.una, challenges())
+	}
+
+	// RST exactly at RCV.NXT resets the connection
+	segmentArrives(pcb, segment{seq: 1000, ack: 5000}, RST|ACK, nil, 0, local, foreign)
+	if pcb.state != PCBStateClosed {
+		t.Errorf("state=%s after RST at RCV.NXT", pcb.state)
+	}
+}
+
+func TestSYNCookie(t *testing.T) {
+	p := &Proto{secret: newSecret()}
+	local, _ := Str2Endpoint("192.0.2.2:80")
+	foreign, _ := Str2Endpoint("192.0.2.1:49152")
+	irs := uint32(0xfffffff0)
+
+	// the largest MSS not above the one of the foreign is restored
+	for _, tc := range []struct{ mss, want uint16 }{{1460, 1460}, {1400, 1300}, {100, 536}} {
+		iss := p.synCookie(local, foreign, irs, tc.mss)
+		mss, ok := p.checkCookie(local, foreign, irs, iss)
+		if !ok || mss != tc.want {
+			t.Errorf("mss=%d,ok=%v, want %d", mss, ok, tc.want)
+		}
+	}
+
+	// the cookie for the other connection is invalid
+	iss := p.synCookie(local, foreign, irs, 1460)
+	other := foreign
+	other.Port++
+	if _, ok := p.checkCookie(local, other, irs, iss); ok {
+		t.Error("cookie with the other endpoint is valid")
+	}
+	other, _ = Str2Endpoint("192.0.2.3:80")
+	if _, ok := p.checkCookie(other, foreign, irs, iss); ok {
+		t.Error("cookie with the other endpoint is valid")
+	}
+}
+
+func TestECN(t *testing.T) {
+	pcb := &pcb{proto: &Proto{ecn: true}, cc: &NewReno{}}
+	pcb.cc.Init(1000)
+
+	// ECN-setup SYN and SYN-ACK
+	pcb.offerOptions()
+	if flag, tos := pcb.ecnFlags(0, SYN, nil); flag != SYN|ECE|CWR || tos != ip.ECNNotECT {
+		t.Errorf("SYN flag=%s,tos=%d", flag, tos)
+	}
+	pcb.agreeECN(SYN | ACK)
+	if pcb.ecnOK {
+		t.Error("ECN is used though SYN-ACK does not have ECE")
+	}
+	pcb.offerOptions()
+	pcb.agreeECN(SYN | ACK | ECE)
+	if !pcb.ecnOK {
+		t.Error("ECN is not used")
+	}
+
+	// only new data is ECN-capable
+	pcb.snd.una = 1000
+	pcb.snd.nxt = 2000
+	if _, tos := pcb.ecnFlags(2000, ACK, []byte("new")); tos != ip.ECNECT0 {
+		t.Errorf("tos of new data is %d", tos)
+	}
+	if _, tos := pcb.ecnFlags(1000, ACK, []byte("old")); tos != ip.ECNNotECT {
+		t.Errorf("tos of retransmission is %d", tos)
+	}
+	if _, tos := pcb.ecnFlags(2000, ACK, nil); tos != ip.ECNNotECT {
+		t.Errorf("tos of pure ACK is %d", tos)
+	}
+
+	// CE is echoed until CWR arrives
+	pcb.receiveECN(segment{ce: true}, ACK)
+	if flag, _ := pcb.ecnFlags(2000, ACK, nil); flag != ACK|ECE {
+		t.Errorf("flag is %s, want ECE", flag)
+	}
+	pcb.receiveECN(segment{}, ACK|CWR)
+	if flag, _ := pcb.ecnFlags(2000, ACK, nil); flag != ACK {
+		t.Errorf("flag is %s after CWR", flag)
+	}
+
+	// the window is reduced once per window and CWR is sent with the next new data
+	pcb.cc.(*NewReno).cwnd = 10000
+	pcb.ecnReduce()
+	pcb.ecnReduce()
+	if cwnd := pcb.cc.Window(); cwnd != 2000 {
+		t.Errorf("cwnd is %d, want 2000", cwnd)
+	}
+	if flag, _ := pcb.ecnFlags(2000, ACK, []byte("new")); flag != ACK|CWR {
+		t.Errorf("flag is %s, want CWR", flag)
+	}
+	if flag, _ := pcb.ecnFlags(2000, ACK, []byte("new")); flag != ACK {
+		t.Errorf("flag is %s after CWR is sent", flag)
+	}
+	pcb.snd.una = 2000
+	pcb.snd.nxt = 12000
+	pcb.ecnReduce()
+	if cwnd := pcb.cc.Window(); cwnd != 5000 {
+		t.Errorf("cwnd is %d, want 5000", cwnd)
+	}
+}
+
+func TestUrgent(t *testing.T) {
+	// the segments are not transmitted actually because of no route
+	pcb := &pcb{proto: &Proto{ip: &ip.IProto{}}}
+	pcb.rcv.nxt = 1000
+	pcb.rcv.wnd = defaultRcvBufferSize
+
+	// URG is set on the segments before SND.UP
+	pcb.snd.up = 2000
+	pcb.sndUrgent = true
+	if flag, up := pcb.urgentPointer(1500, ACK); flag != ACK|URG || up != 500 {
+		t.Errorf("flag=%s,up=%d", flag, up)
+	}
+	if flag, up := pcb.urgentPointer(2000, ACK); flag != ACK || up != 0 {
+		t.Errorf("segment after SND.UP has flag=%s,up=%d", flag, up)
+	}
+	if _, up := pcb.urgentPointer(pcb.snd.up-0x20000, ACK); up != 0xffff {
+		t.Errorf("far urgent pointer is %d, want 0xffff", up)
+	}
+
+	// the urgent pointer is signaled before the urgent data arrives,
+	// the last octet of it is taken out of the stream
+	pcb.receiveUrgent(segment{seq: 1000, up: 8})
+	if !pcb.rcvUrgent || pcb.rcv.up != 1008 {
+		t.Errorf("rcvUrgent=%v,rcv.up=%d", pcb.rcvUrgent, pcb.rcv.up)
+	}
+	pcb.receiveText(1000, []byte("abcd"), false)
+	pcb.receiveText(1004, []byte("efgh!ijk"), false)
+	if pcb.rcvUrgent || !pcb.oobValid || pcb.oob != 'h' {
+		t.Errorf("rcvUrgent=%v,oobValid=%v,oob=%c", pcb.rcvUrgent, pcb.oobValid, pcb.oob)
+	}
+	if received := peekAll(&pcb.rxBuf); received != "abcdefg!ijk" {
+		t.Errorf("received %q", received)
+	}
+
+	// read stops at the urgent mark
+	buf := make([]byte, 16)
+	if n := pcb.read(buf); string(buf[:n]) != "abcdefg" || !pcb.AtMark() {
+		t.Errorf("read %q before the mark, at mark %v", buf[:n], pcb.AtMark())
+	}
+	if n := pcb.read(buf); string(buf[:n]) != "!ijk" || pcb.AtMark() {
+		t.Errorf("read %q after the mark, at mark %v", buf[:n], pcb.AtMark())
+	}
+	if n, err := pcb.ReadUrgent(buf, nil); n != 1 || err != nil || buf[0] != 'h' {
+		t.Errorf("ReadUrgent n=%d,err=%v", n, err)
+	}
+
+	// the urgent pointer to the data already delivered is ignored
+	pcb.receiveUrgent(segment{seq: 1000, up: 10})
+	if pcb.rcvUrgent {
+		t.Error("urgent data already delivered is signaled")
+	}
+
+	// inline mode leaves the urgent data in the stream
+	pcb.SetOOBInline(true)
+	pcb.receiveUrgent(segment{seq: 1012, up: 2})
+	pcb.receiveText(1012, []byte("xyz"), false)
+	if received := peekAll(&pcb.rxBuf); received != "xyz" || pcb.oobValid {
+		t.Errorf("received %q,oobValid=%v", received, pcb.oobValid)
+	}
+	if n := pcb.read(buf); string(buf[:n]) != "x" || !pcb.AtMark() {
+		t.Errorf("read %q before the mark, at mark %v", buf[:n], pcb.AtMark())
+	}
+	if _, err := pcb.ReadUrgent(buf, nil); err == nil {
+		t.Error("urgent data is read out of band in inline mode")
+	}
+}
+
+func TestTimerWheel(t *testing.T) {
+	w := &timerWheel{}
+	w.init()
+	w.start = w.start.Add(time.Hour) // the wheel starts at tick 0 however long the test takes
+
+	// the timers on every level and the one beyond the wheel
+	ticks := []uint64{0, 1, 63, 64, 65, 4095, 4096, 4100, 300000, wheelSpan + 10}
+	timers := make([]wheelTimer, len(ticks))
+	fired := make([]uint64, len(ticks))
+	var now uint64
+	for i := range timers {
+		i := i
+		timers[i].f = func() { fired[i] = now }
+		w.add(&timers[i], w.start.Add(time.Duration(ticks[i])*timerInterval))
+	}
+
+	// the canceled timer never fires
+	var canceled wheelTimer
+	canceled.f = func() { t.Error("canceled timer fires") }
+	w.add(&canceled, w.start.Add(100*timerInterval))
+	w.remove(&canceled)
+
+	// the wheel is advanced only at the ticks which next returns
+	var advances int
+	for at, ok := w.next(); ok; at, ok = w.next() {
+		now = w.tick(at, false)
+		for _, timer := range w.advance(at) {
+			timer.f()
+		}
+		advances++
+	}
+	if advances > 2*len(ticks) {
+		t.Errorf("the wheel is advanced %d times", advances)
+	}
+	for i, tick := range ticks {
+		want := tick
+		if tick >= wheelSpan { // too far, expires early at the end of the wheel
+			want = wheelSpan - 1
+		}
+		if fired[i] != want {
+			t.Errorf("timer at %d fires at %d, want %d", tick, fired[i], want)
+		}
+	}
+	if w.count != 0 {
+		t.Errorf("%d timers remain", w.count)
+	}
+
+	// the timer which expires before the owner wakes up wakes it
+	w = &timerWheel{wake: make(chan struct{}, 1)}
+	w.init()
+	w.start = w.start.Add(time.Hour)
+	var far, near wheelTimer
+	w.add(&far, w.start.Add(1000*timerInterval))
+	<-w.wake
+	w.next()
+	w.add(&near, w.start.Add(10*timerInterval))
+	select {
+	case <-w.wake:
+	default:
+		t.Error("the earlier timer does not wake the owner")
+	}
+	if at, _ := w.next(); w.tick(at, false) != near.expire {
+		t.Errorf("next tick is %d, want %d", w.tick(at, false), near.expire)
+	}
+}
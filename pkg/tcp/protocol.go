@@ -3,25 +3,52 @@ package tcp
 import (
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/hedwig100/go-network/pkg/ip"
-	"github.com/hedwig100/go-network/pkg/utils"
+	"github.com/hedwig100/go-network/pkg/port"
 )
 
-func Init(done chan struct{}) error {
-	go tcpTimer(done)
+// Init prepare the TCP protocol and registers it to the IP protocol.
+func Init(ipProto *ip.IProto, done chan struct{}) (*Proto, error) {
 	rand.Seed(time.Now().UnixNano())
-	return ip.ProtoRegister(&Proto{})
+	ports, err := port.NewAllocator()
+	if err != nil {
+		return nil, err
+	}
+	p := &Proto{
+		conns:          make(map[connKey]*pcb),
+		listeners:      make(map[Endpoint]*pcb),
+		ports:          ports,
+		rstLimit:       rateLimiter{rate: rstRateLimit, burst: rstRateLimit},
+		challengeLimit: rateLimiter{rate: challengeAckLimit, burst: challengeAckLimit},
+		secret:         newSecret(),
+		ecn:            true,
+		finTimeout:     defaultFinTimeout,
+		wheel:          timerWheel{wake: make(chan struct{}, 1)},
+		ip:             ipProto,
+	}
+	err = ipProto.ProtoRegister(p)
+	if err != nil {
+		return nil, err
+	}
+	go p.timer(done)
+	return p, nil
 }
 
 type segment struct {
-	seq uint32
-	ack uint32
-	len uint32
-	wnd uint16
-	up  uint16
+	seq  uint32
+	ack  uint32
+	len  uint32
+	wnd  uint32
+	up   uint16
+	opts Options
+
+	// congestion experienced is marked in the IP header
+	ce bool
 }
 
 /*
@@ -29,73 +56,108 @@ type segment struct {
 */
 // Proto is struct for TCP protocol handler.
 // This implements IPUpperProtocol interface.
-type Proto struct{}
+// Proto has the TCP protocol control blocks of the stack.
+type Proto struct {
+	mutex sync.Mutex
+	pcbs  []*pcb
+
+	// the connections keyed by the pair of the endpoints and
+	// the listening pcbs keyed by the local endpoint
+	conns     map[connKey]*pcb
+	listeners map[Endpoint]*pcb
+
+	// allocator of the ephemeral port
+	ports *port.Allocator
+
+	// limits the resets sent for the segments which no connection has
+	rstLimit rateLimiter
+
+	// limits the challenge ACKs sent by all the connections
+	challengeLimit rateLimiter
+
+	// secret key for ISN and SYN cookie
+	secret [16]byte
+
+	// the connections negotiate ECN
+	ecn bool
+
+	// the orphaned connection is aborted after it is in FIN-WAIT-2 for this time
+	finTimeout time.Duration
+
+	// drives the timers of the pcbs
+	wheel timerWheel
+
+	// IP protocol which transmits TCP segment
+	ip *ip.IProto
+}
 
 func (p *Proto) Type() ip.ProtoType {
 	return ip.ProtoTCP
 }
 
 func (p *Proto) RxHandler(data []byte, src ip.Addr, dst ip.Addr, ipIface *ip.Iface) error {
+	return p.RxHandlerTos(data, src, dst, ip.ECNNotECT, ipIface)
+}
 
+// RxHandlerTos receives the segment with TOS field of IP header, which has ECN codepoint
+func (p *Proto) RxHandlerTos(data []byte, src ip.Addr, dst ip.Addr, tos uint8, ipIface *ip.Iface) error {
+
+	// payload has the options at the head, which are cut off below
 	hdr, payload, err := data2header(data, src, dst)
-	// TODO:
-	// have to treat header part of payload (payload may have header because we cut data with-HeaderSizeMin)
 	if err != nil {
 		return err
 	}
 
-	// search TCP pcb
-	var pcb *pcb
-	for _, candidate := range pcbs {
-		if candidate.local.Addr == dst && candidate.local.Port == hdr.Dst {
-			pcb = candidate
-			break
-		}
+	local := Endpoint{
+		Addr: dst,
+		Port: hdr.Dst,
 	}
-	if pcb == nil {
-		return fmt.Errorf("TCP socket whose address is %s:%d not found", dst, hdr.Dst)
+	foreign := Endpoint{
+		Addr: src,
+		Port: hdr.Src,
 	}
 
 	hdrLen := (hdr.Offset >> 4) << 2
+	if hdrLen < HeaderSizeMin || len(data) < int(hdrLen) {
+		return fmt.Errorf("TCP data offset is invalid(offset=%d)", hdrLen)
+	}
 	dataLen := uint32(len(data)) - uint32(hdrLen)
 	log.Printf("[D] TCP rxHandler: src=%s:%d,dst=%s:%d,iface=%s,len=%d,tcp header=%s,payload=%v", src, hdr.Src, dst, hdr.Dst, ipIface.Family(), dataLen, hdr, payload)
 
 	// segment
 	seg := segment{
-		seq: hdr.Seq,
-		ack: hdr.Ack,
-		len: dataLen,
-		wnd: hdr.Window,
-		up:  hdr.Urgent,
+		seq:  hdr.Seq,
+		ack:  hdr.Ack,
+		len:  dataLen,
+		wnd:  uint32(hdr.Window),
+		up:   hdr.Urgent,
+		opts: parseOptions(payload[:hdrLen-HeaderSizeMin]),
+		ce:   tos&ip.ECNMask == ip.ECNCE,
 	}
 	if isSet(hdr.Flag, SYN|FIN) {
 		seg.len++
 	}
 
-	foreign := Endpoint{
-		Addr: src,
-		Port: hdr.Src,
+	// search TCP pcb,
+	// the pcb connected to the foreign has priority over the listening one
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pcb := p.lookup(local, foreign)
+	if pcb == nil {
+		log.Printf("[D] TCP socket whose address is %s not found", local)
+		return p.reset(local, foreign, seg, hdr.Flag)
 	}
 
-	return segmentArrives(pcb, seg, hdr.Flag, payload[hdrLen-HeaderSizeMin:], dataLen, foreign)
+	return segmentArrives(pcb, seg, hdr.Flag, payload[hdrLen-HeaderSizeMin:], dataLen, local, foreign)
 }
 
-func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLen uint32, foreign Endpoint) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+// segmentArrives processes the segment from foreign to local for the pcb. mutex must be held by the caller.
+func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLen uint32, local Endpoint, foreign Endpoint) error {
+	defer pcb.notify()
 
 	switch pcb.state {
 	case PCBStateClosed:
-		if isSet(flag, RST) {
-			// An incoming segment containing a RST is discarded
-			return nil
-		}
-		// ACK bit is off
-		if !isSet(flag, ACK) {
-			return TxHandler(pcb.local, pcb.foreign, []byte{}, 0, seg.seq+seg.len, RST|ACK, 0, 0)
-		}
-		// ACK bit is on
-		return TxHandler(pcb.local, pcb.foreign, []byte{}, seg.ack, 0, RST, 0, 0)
+		return pcb.proto.reset(local, foreign, seg, flag)
 
 	case PCBStateListen:
 		// first check for an RST
@@ -106,29 +168,55 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 
 		// second check for an ACK
 		if isSet(flag, ACK) {
+			// the ACK may return the SYN cookie, then the connection is established
+			if pcb.synCookies && !isSet(flag, SYN) {
+				if child, ok := pcb.cookieAck(local, foreign, seg); ok {
+					if child == nil {
+						// the ACK is dropped without RST so that the foreign retransmits it (or the data)
+						// after the accept queue has room
+						log.Printf("[D] TCP accept queue is full, ACK from %s is dropped", foreign)
+						return nil
+					}
+					return segmentArrives(child, seg, flag, data, dataLen, local, foreign)
+				}
+			}
+
 			// Any acknowledgment is bad if it arrives on a connection still in the LISTEN state.
 			// An acceptable reset segment should be formed for any arriving ACK-bearing segment.
-			return TxHandler(pcb.local, pcb.foreign, []byte{}, seg.ack, 0, RST, 0, 0)
+			return pcb.proto.TxHandler(local, foreign, []byte{}, seg.ack, 0, RST, 0, 0)
 		}
 
 		// third check for a SYN
 		if isSet(flag, SYN) {
 			// ignore security check
 
-			pcb.foreign = foreign
-			pcb.rcv.wnd = bufferSize
-			pcb.rcv.nxt = seg.seq + 1
-			pcb.irs = seg.seq
-
-			pcb.iss = createISS()
-			pcb.snd.nxt = pcb.iss + 1
-			pcb.snd.una = pcb.iss
-			pcb.foreign = foreign
-			pcb.transition(PCBStateSYNReceived)
+			// the listening pcb remains in LISTEN and the new pcb is made for the connection,
+			// the SYN is dropped if the backlog is full so that the foreign retransmits it later.
+			child := pcb.spawn(local, foreign)
+			if child == nil {
+				if pcb.synCookies {
+					return pcb.sendCookie(local, foreign, seg)
+				}
+				log.Printf("[D] TCP backlog is full, SYN from %s is dropped", foreign)
+				return nil
+			}
 
-			copy(pcb.rxQueue[pcb.rxLen:], data)
-			pcb.rxLen += uint16(dataLen)
-			return TxHelperTCP(pcb, SYN|ACK, []byte{}, 0, nil)
+			child.rcv.wnd = child.rcvBufSize
+			child.rcv.nxt = seg.seq + 1
+			child.irs = seg.seq
+			child.advMSS = child.proto.mssFor(foreign.Addr)
+			child.mss = sendMSS(seg.opts.MSS, child.advMSS)
+			child.offerOptions()
+			child.agreeOptions(seg.opts)
+			child.agreeECN(flag)
+
+			child.iss = child.proto.createISS(local, foreign)
+			child.snd.nxt = child.iss + 1
+			child.snd.una = child.iss
+			child.transition(PCBStateSYNReceived)
+
+			// the text in SYN is not acknowledged, which is retransmitted by the foreign
+			return TxHelperTCP(child, SYN|ACK, []byte{}, 0, nil)
 		}
 
 		// fourth other text or control
@@ -142,7 +230,7 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 			// If SEG.ACK =< ISS, or SEG.ACK > SND.NXT, send a reset (unless
 			// the RST bit is set, if so drop the segment and return)
 			if seg.ack <= pcb.iss || seg.ack > pcb.snd.nxt {
-				return TxHandler(pcb.local, pcb.foreign, []byte{}, seg.ack, 0, RST, 0, 0)
+				return pcb.proto.TxHandler(pcb.local, pcb.foreign, []byte{}, seg.ack, 0, RST, 0, 0)
 			}
 			if pcb.snd.una <= seg.ack && seg.ack <= pcb.snd.nxt {
 				// this ACK is  acceptable
@@ -168,6 +256,9 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 		if isSet(flag, SYN) {
 			pcb.rcv.nxt = seg.seq + 1
 			pcb.irs = seg.seq
+			pcb.mss = sendMSS(seg.opts.MSS, pcb.advMSS)
+			pcb.agreeOptions(seg.opts)
+			pcb.agreeECN(flag)
 
 			if acceptable { // our SYN has been ACKed
 				pcb.snd.una = seg.ack
@@ -176,7 +267,10 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 
 			if pcb.snd.una > pcb.iss {
 				pcb.transition(PCBStateEstablished)
+				pcb.cc.Init(uint32(pcb.mss))
+				pcb.recover = pcb.iss
 				pcb.snd.wnd = seg.wnd
+				pcb.snd.maxWnd = seg.wnd
 				pcb.snd.wl1 = seg.seq
 				pcb.snd.wl2 = seg.ack
 
@@ -198,6 +292,17 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 		return nil
 
 	default:
+		// the window of the segment is scaled except for SYN
+		if !isSet(flag, SYN) {
+			seg.wnd <<= pcb.sndScale
+		}
+
+		// check the timestamp before the sequence number (PAWS)
+		if !pcb.paws(seg, flag) {
+			log.Printf("[D] TCP segment discarded by PAWS tsval=%d,ts.recent=%d", seg.opts.TSVal, pcb.tsRecent)
+			return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
+		}
+
 		// first check sequence number
 		var acceptable bool
 		if pcb.rcv.wnd == 0 {
@@ -208,10 +313,10 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 				acceptable = false
 			}
 		} else {
-			if seg.len == 0 && (pcb.rcv.nxt <= seg.seq && seg.seq < pcb.rcv.nxt+uint32(pcb.rcv.wnd)) {
+			if seg.len == 0 && pcb.inWindow(seg.seq) {
 				acceptable = true
 			}
-			if seg.len > 0 && (pcb.rcv.nxt <= seg.seq && seg.seq < pcb.rcv.nxt+uint32(pcb.rcv.wnd)) || (pcb.rcv.nxt <= seg.seq+seg.len-1 && seg.seq+seg.len-1 < pcb.rcv.nxt+uint32(pcb.rcv.wnd)) {
+			if seg.len > 0 && (pcb.inWindow(seg.seq) || pcb.inWindow(seg.seq+seg.len-1)) {
 				acceptable = true
 			}
 		}
@@ -223,19 +328,21 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 			return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
 		}
 
-		// TODO:
+		pcb.updateTSRecent(seg)
+
+		pcb.receiveECN(seg, flag)
+
 		// In the following it is assumed that the segment is the idealized
 		// segment that begins at RCV.NXT and does not exceed the window.
-		// One could tailor actual segments to fit this assumption by
-		// trimming off any portions that lie outside the window (including
-		// SYN and FIN), and only processing further if the segment then
-		// begins at RCV.NXT.  Segments with higher begining sequence
-		// numbers may be held for later processing.
-		//
-		// right := min(pcb.rcv.nxt+uint32(pcb.rcv.wnd)-seg.seq, dataLen)
-		// data = data[pcb.rcv.nxt-seg.seq : right]
-
-		// second check the RST bit
+		// The segment text is trimmed in the seventh step, and the segments with
+		// higher begining sequence numbers are held in the reassembly queue.
+
+		// second check the RST bit,
+		// the connection is reset only if the sequence number exactly matches RCV.NXT,
+		// otherwise the challenge ACK is sent (RFC5961 3.2)
+		if isSet(flag, RST) && seg.seq != pcb.rcv.nxt {
+			return pcb.challengeAck()
+		}
 		switch pcb.state {
 		case PCBStateSYNReceived:
 			if isSet(flag, RST) {
@@ -270,12 +377,9 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 		case PCBStateSYNReceived, PCBStateEstablished, PCBStateFINWait1, PCBStateFINWait2,
 			PCBStateCloseWait, PCBStateClosing, PCBStateLastACK, PCBStateTimeWait:
 			if isSet(flag, SYN) {
-				// any outstanding RECEIVEs and SEND should receive "reset" responses,
-				// all segment queues should be flushed, the user should also
-				// receive an unsolicited general "connection reset" signal
-				pcb.signalErr("connection reset")
-				pcb.transition(PCBStateClosed)
-				return TxHelperTCP(pcb, RST, []byte{}, 0, nil)
+				// the SYN is answered with the challenge ACK whatever the sequence number is,
+				// the foreign which has really restarted sends RST for it (RFC5961 4.2)
+				return pcb.challengeAck()
 			}
 		}
 
@@ -284,18 +388,49 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 			log.Printf("[D] TCP segment discarded")
 			return nil
 		}
+
+		// the ACK is acceptable only if SND.UNA - MAX.SND.WND =< SEG.ACK =< SND.NXT,
+		// otherwise the segment is discarded and the challenge ACK is sent (RFC5961 5.2)
+		if pcb.state != PCBStateSYNReceived &&
+			(seqLT(seg.ack, pcb.snd.una-pcb.snd.maxWnd) || seqLT(pcb.snd.nxt, seg.ack)) {
+			return pcb.challengeAck()
+		}
 		switch pcb.state {
 		case PCBStateSYNReceived:
 			if pcb.snd.una <= seg.ack && seg.ack <= pcb.snd.nxt {
 				pcb.transition(PCBStateEstablished)
+				pcb.cc.Init(uint32(pcb.mss))
+				pcb.recover = pcb.iss
+
+				// set the send window (RFC9293)
+				pcb.snd.wnd = seg.wnd
+				pcb.snd.maxWnd = seg.wnd
+				pcb.snd.wl1 = seg.seq
+				pcb.snd.wl2 = seg.ack
 			} else {
 				log.Printf("unacceptable ACK is sent")
-				return TxHandler(pcb.local, pcb.foreign, []byte{}, seg.ack, 0, RST, 0, 0)
+				return pcb.proto.TxHandler(pcb.local, pcb.foreign, []byte{}, seg.ack, 0, RST, 0, 0)
 			}
 			fallthrough
 		case PCBStateEstablished, PCBStateFINWait1, PCBStateFINWait2, PCBStateCloseWait, PCBStateClosing:
-			if pcb.snd.una < seg.ack && seg.ack <= pcb.snd.nxt {
+			// the foreign is alive, the segment which has passed the checks above
+			// cannot be forged by the off-path attacker easily
+			pcb.lastRxTime = time.Now()
+			pcb.keepProbes = 0
+
+			if pcb.sackOK && len(seg.opts.SACK) > 0 {
+				pcb.updateScoreboard(seg.opts.SACK)
+			}
+			if pcb.ecnOK && isSet(flag, ECE) {
+				pcb.ecnReduce()
+			}
+
+			if seqLT(pcb.snd.una, seg.ack) && seqLE(seg.ack, pcb.snd.nxt) {
+				acked := seg.ack - pcb.snd.una
 				pcb.snd.una = seg.ack
+				if pcb.sndUrgent && seqLE(pcb.snd.up, pcb.snd.una) {
+					pcb.sndUrgent = false // the urgent data is acknowledged
+				}
 
 				// Users should receive
 				// positive acknowledgments for buffers which have been SENT and
@@ -303,30 +438,42 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 				// "ok" response)
 				// in removeQueue function
 				pcb.queueAck()
+				if pcb.tsOK && seg.opts.HasTimestamp && seg.opts.TSEcr != 0 {
+					// RTT is measured with the timestamp echoed, whose unit is 1ms
+					rtt := time.Duration(pcb.tsNow()-seg.opts.TSEcr) * time.Millisecond
+					if rtt == 0 {
+						rtt = time.Millisecond
+					}
+					pcb.updateRTO(rtt)
+				}
+				pcb.newAck(acked)
+				pcb.updateWindow(seg)
 
-				// Note that SND.WND is an offset from SND.UNA, that SND.WL1
-				// records the sequence number of the last segment used to update
-				// SND.WND, and that SND.WL2 records the acknowledgment number of
-				// the last segment used to update SND.WND.  The check here
-				// prevents using old segments to update the window.
-				if pcb.snd.wl1 < seg.seq || (pcb.snd.wl1 == seg.seq && pcb.snd.wl2 <= seg.ack) {
-					pcb.snd.wnd = seg.wnd
-					pcb.snd.wl1 = seg.seq
-					pcb.snd.wl2 = seg.ack
+				// the window may be opened, send the queued data
+				if err := pcb.output(); err != nil {
+					log.Printf("[E] TCP output error %s", err.Error())
+				}
+			} else if seg.ack == pcb.snd.una {
+				if seg.len == 0 && seg.wnd == pcb.snd.wnd && pcb.snd.nxt != pcb.snd.una {
+					// duplicate ACK (RFC5681), which may tell the segment is lost
+					pcb.dupAck()
+				} else {
+					// window update, which may be the response to the window probe
+					pcb.updateWindow(seg)
+				}
+				if err := pcb.output(); err != nil {
+					log.Printf("[E] TCP output error %s", err.Error())
 				}
-			} else if seg.ack < pcb.snd.una {
+			} else if seqLT(seg.ack, pcb.snd.una) {
 				// If the ACK is a duplicate (SEG.ACK < SND.UNA), it can be ignored.
-			} else if seg.ack > pcb.snd.nxt {
-				// ??
-				// If the ACK acks something not yet sent (SEG.ACK > SND.NXT) then send an ACK, drop the segment, and return.
-				return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
+				// The ACK of something not yet sent (SEG.ACK > SND.NXT) has been dropped above.
 			}
 
 			switch pcb.state {
 			case PCBStateFINWait1:
 				// In addition to the processing for the ESTABLISHED state,
 				// if our FIN is now acknowledged then enter FIN-WAIT-2 and continue processing in that state.
-				if seg.ack == pcb.snd.nxt {
+				if seg.ack == pcb.snd.nxt && !pcb.finQueued {
 					pcb.transition(PCBStateFINWait2)
 				}
 			case PCBStateFINWait2:
@@ -340,7 +487,8 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 			case PCBStateClosing:
 				// In addition to the processing for the ESTABLISHED state,
 				// if the ACK acknowledges our FIN then enter the TIME-WAIT state, otherwise ignore the segment.
-				if seg.ack == pcb.snd.nxt {
+				// FIN may be still queued behind the data not sent.
+				if seg.ack == pcb.snd.nxt && !pcb.finQueued {
 					pcb.transition(PCBStateTimeWait)
 					pcb.lastTxTime = time.Now()
 				}
@@ -368,20 +516,18 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 		// sixth, check the URG bit,
 		switch pcb.state {
 		case PCBStateEstablished, PCBStateFINWait1, PCBStateFINWait2:
-			if isSet(flag, RST) {
-				pcb.rcv.up = utils.Max(pcb.rcv.up, seg.up)
-				// TODO:
-				// signal the user that the remote side has urgent data if the urgent
-				// pointer (RCV.UP) is in advance of the data consumed.  If the
-				// user has already been signaled (or is still in the "urgent
-				// mode") for this continuous sequence of urgent data, do not
-				// signal the user again.
+			if isSet(flag, URG) {
+				// set RCV.UP to max(RCV.UP,SEG.UP), and signal the user that the
+				// remote side has urgent data if the urgent pointer (RCV.UP) is in
+				// advance of the data consumed.
+				pcb.receiveUrgent(seg)
 			}
 		case PCBStateCloseWait, PCBStateClosing, PCBStateLastACK, PCBStateTimeWait:
 			// ignore
 		}
 
 		// seventh, process the segment text
+		fin := isSet(flag, FIN)
 		switch pcb.state {
 		case PCBStateEstablished, PCBStateFINWait1, PCBStateFINWait2:
 			// Once in the ESTABLISHED state, it is possible to deliver segment
@@ -390,17 +536,32 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 			// empty.  If the segment empties and carries an PUSH flag, then
 			// the user is informed, when the buffer is returned, that a PUSH
 			// has been received.
-			if dataLen > 0 {
-				copy(pcb.rxQueue[pcb.rxLen:], data)
-				pcb.rxLen += uint16(dataLen)
-				pcb.rcv.nxt = seg.seq + seg.len
-				pcb.rcv.wnd -= uint16(dataLen)
+			if dataLen > 0 || fin {
+				outOfOrder := seqLT(pcb.rcv.nxt, seg.seq)
+				filled := len(pcb.reassembly) > 0
+				fin = pcb.receiveText(seg.seq, data, fin)
 				pcb.signalCmd(triggerReceive)
 
-				// TODO:
+				// the segment out of order is acknowledged immediately (duplicate ACK)
+				// so that the foreign can detect the loss, so is the one filling the gap (RFC5681).
+				if outOfOrder {
+					log.Printf("[D] TCP segment out of order seq=%d,rcv.nxt=%d", seg.seq, pcb.rcv.nxt)
+					return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
+				}
+				if filled && !fin {
+					return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
+				}
+
+				// the congestion experienced is echoed without delay
+				if pcb.ecnEcho && seg.ce && !fin {
+					return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
+				}
+
 				// This acknowledgment should be piggybacked on a segment being
 				// transmitted if possible without incurring undue delay.
-				return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
+				if !fin { // FIN is acknowledged with the data below
+					return pcb.delayAck()
+				}
 			}
 		case PCBStateCloseWait, PCBStateClosing, PCBStateLastACK, PCBStateTimeWait:
 			// ignore
@@ -414,18 +575,25 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 		default:
 		}
 
-		if isSet(flag, FIN) {
+		if fin {
 			// FIN bit is set
 			// signal the user "connection closing" and return any pending RECEIVEs with same message,
 			pcb.signalCmd(triggerReceive)
-			pcb.rcv.nxt = seg.seq + 1
+			if pcb.rcvCmd.errCh != nil {
+				pcb.rcvCmd.errCh <- fmt.Errorf("connection closing")
+				pcb.rcvCmd = rcvCmd{}
+			}
+			if !pcb.finReceived { // FIN occupies one sequence number
+				pcb.finReceived = true
+				pcb.rcv.nxt++
+			}
 
 			switch pcb.state {
 			case PCBStateSYNReceived, PCBStateEstablished:
 				pcb.transition(PCBStateCloseWait)
 				return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
 			case PCBStateFINWait1:
-				if seg.ack == pcb.snd.nxt {
+				if seg.ack == pcb.snd.nxt && !pcb.finQueued {
 					pcb.transition(PCBStateTimeWait)
 					// time-wait timer, turn off the other timers
 					pcb.lastTxTime = time.Now()
@@ -451,12 +619,50 @@ func segmentArrives(pcb *pcb, seg segment, flag ControlFlag, data []byte, dataLe
 	return nil
 }
 
+// reset replies to the segment from foreign to local which no connection has (RFC793 p.65),
+// the reply is limited to rstRateLimit segments per second.
+// mutex must be held by the caller.
+func (p *Proto) reset(local Endpoint, foreign Endpoint, seg segment, flag ControlFlag) error {
+	// An incoming segment containing a RST is discarded
+	if isSet(flag, RST) {
+		return nil
+	}
+	// the segment to the broadcast or multicast address is not replied (RFC1122 4.2.3.10)
+	if local.Addr == ip.AddrBroadcast || local.Addr>>28 == 0xe {
+		return nil
+	}
+	if !p.rstLimit.allow(time.Now()) {
+		log.Printf("[D] TCP reset to %s is suppressed by the rate limit", foreign)
+		return nil
+	}
+
+	// ACK bit is off
+	if !isSet(flag, ACK) {
+		return p.TxHandler(local, foreign, []byte{}, 0, seg.seq+seg.len, RST|ACK, 0, 0)
+	}
+	// ACK bit is on
+	return p.TxHandler(local, foreign, []byte{}, seg.ack, 0, RST, 0, 0)
+}
+
+// challengeAck sends the ACK in reply to the segment which may be injected by the off-path attacker,
+// the true foreign answers it with the RST which exactly matches or just ignores it (RFC5961).
+// The challenge ACKs are limited to challengeAckLimit per second among all the connections.
+// mutex must be held by the caller.
+func (pcb *pcb) challengeAck() error {
+	if !pcb.proto.challengeLimit.allow(time.Now()) {
+		log.Printf("[D] TCP challenge ACK is suppressed by the rate limit: local=%s", pcb.local)
+		return nil
+	}
+	log.Printf("[D] TCP challenge ACK: local=%s,foreign=%s", pcb.local, pcb.foreign)
+	return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
+}
+
 func TxHelperTCP(pcb *pcb, flag ControlFlag, data []byte, trigger uint8, errCh chan error) error {
 	seq := pcb.snd.nxt
 	if isSet(flag, SYN) {
 		seq = pcb.iss
 	}
-	if err := TxHandler(pcb.local, pcb.foreign, data, seq, pcb.rcv.nxt, flag, pcb.rcv.wnd, pcb.rcv.up); err != nil {
+	if err := pcb.transmit(seq, flag, data); err != nil {
 		return err
 	}
 	if isSet(flag, SYN|FIN) || len(data) > 0 {
@@ -465,19 +671,52 @@ func TxHelperTCP(pcb *pcb, flag ControlFlag, data []byte, trigger uint8, errCh c
 	return nil
 }
 
-func TxHandler(src Endpoint, dst Endpoint, payload []byte, seq uint32, ack uint32, flag ControlFlag, wnd uint16, up uint16) error {
+// transmit sends the segment of the pcb with the options for the flag.
+func (pcb *pcb) transmit(seq uint32, flag ControlFlag, data []byte) error {
+	opts := pcb.segmentOptions(flag)
+
+	// the window in SYN is never scaled
+	wnd := pcb.rcv.wnd
+	if !isSet(flag, SYN) {
+		wnd >>= pcb.rcvScale
+	}
+	if wnd > math.MaxUint16 {
+		wnd = math.MaxUint16
+	}
+
+	pcb.bytesSent += uint64(len(data))
+	if isSet(flag, ACK) { // the delayed ACK is piggybacked
+		pcb.lastAckSent = pcb.rcv.nxt
+		pcb.ackPending = 0
+	}
+	flag, up := pcb.urgentPointer(seq, flag)
+	flag, tos := pcb.ecnFlags(seq, flag, data)
+	return pcb.proto.txHandler(pcb.local, pcb.foreign, opts, data, seq, pcb.rcv.nxt, flag, uint16(wnd), up, tos)
+}
+
+func (p *Proto) TxHandler(src Endpoint, dst Endpoint, payload []byte, seq uint32, ack uint32, flag ControlFlag, wnd uint16, up uint16) error {
+	return p.txHandler(src, dst, Options{}, payload, seq, ack, flag, wnd, up, ip.ECNNotECT)
+}
+
+func (p *Proto) txHandler(src Endpoint, dst Endpoint, opts Options, payload []byte, seq uint32, ack uint32, flag ControlFlag, wnd uint16, up uint16, tos uint8) error {
 
 	if len(payload)-HeaderSizeMin > ip.PayloadSizeMax {
 		return fmt.Errorf("data size is too large for TCP payload")
 	}
 
+	// options are put before the payload
+	optData := opts.encode()
+	if len(optData) > 0 {
+		payload = append(optData, payload...)
+	}
+
 	// transform TCP header to byte strings
 	hdr := Header{
 		Src:    src.Port,
 		Dst:    dst.Port,
 		Seq:    seq,
 		Ack:    ack,
-		Offset: (HeaderSizeMin >> 2) << 4,
+		Offset: uint8((HeaderSizeMin+len(optData))>>2) << 4,
 		Flag:   flag,
 		Window: wnd,
 		Urgent: up,
@@ -487,6 +726,6 @@ func TxHandler(src Endpoint, dst Endpoint, payload []byte, seq uint32, ack uint3
 		return err
 	}
 
-	log.Printf("[D] TCP TxHandler: src=%s,dst=%s,len=%d,tcp header=%s", src, dst, len(payload), hdr)
-	return ip.TxHandler(ip.ProtoTCP, data, src.Addr, dst.Addr)
+	log.Printf("[D] TCP TxHandler: src=%s,dst=%s,len=%d,tcp header=%s,options=%s", src, dst, len(payload)-len(optData), hdr, opts)
+	return p.ip.TxHandlerTos(ip.ProtoTCP, data, src.Addr, dst.Addr, tos)
 }
@@ -0,0 +1,118 @@
+package tcp
+
+import (
+	"log"
+
+	"github.com/hedwig100/go-network/pkg/ip"
+)
+
+/*
+	pcb table
+*/
+
+// connKey is the key of the connection, which is the pair of the local and foreign endpoint
+type connKey struct {
+	local   Endpoint
+	foreign Endpoint
+}
+
+// hashed is the key with which the pcb is in the table
+type hashed struct {
+	listen bool
+	key    connKey
+}
+
+// rehash puts the pcb into the table according to its state and endpoints,
+// the listening pcb is looked up with the local endpoint and the others with the pair of the endpoints.
+// mutex must be held by the caller.
+func (p *Proto) rehash(pcb *pcb) {
+	p.unhash(pcb)
+
+	if pcb.state == PCBStateListen {
+		p.listeners[pcb.local] = pcb
+		pcb.hashed = &hashed{listen: true, key: connKey{local: pcb.local}}
+		return
+	}
+
+	if pcb.foreign == (Endpoint{}) {
+		return
+	}
+	key := connKey{local: pcb.local, foreign: pcb.foreign}
+	p.conns[key] = pcb
+	pcb.hashed = &hashed{key: key}
+}
+
+// unhash removes the pcb from the table. mutex must be held by the caller.
+func (p *Proto) unhash(pcb *pcb) {
+	h := pcb.hashed
+	if h == nil {
+		return
+	}
+	pcb.hashed = nil
+
+	// the entry may have been replaced with the other pcb
+	if h.listen {
+		if p.listeners[h.key.local] == pcb {
+			delete(p.listeners, h.key.local)
+		}
+		return
+	}
+	if p.conns[h.key] == pcb {
+		delete(p.conns, h.key)
+	}
+}
+
+// lookup returns the pcb to which the segment from foreign to local is delivered.
+// The connection whose endpoints match exactly has priority over the listening pcb,
+// and the listening pcb bound to the local address has priority over the wildcard one.
+// mutex must be held by the caller.
+func (p *Proto) lookup(local Endpoint, foreign Endpoint) *pcb {
+	if pcb, ok := p.conns[connKey{local: local, foreign: foreign}]; ok {
+		return pcb
+	}
+	if pcb, ok := p.listeners[local]; ok {
+		return pcb
+	}
+	if pcb, ok := p.listeners[Endpoint{Addr: ip.AddrAny, Port: local.Port}]; ok {
+		return pcb
+	}
+	return nil
+}
+
+// portUsed reports whether the connection from local to foreign cannot use local,
+// the port can be shared by the connections to the different foreigns,
+// but not with the listening pcb. mutex must be held by the caller.
+func (p *Proto) portUsed(local Endpoint, foreign Endpoint) bool {
+	if _, ok := p.conns[connKey{local: local, foreign: foreign}]; ok {
+		return true
+	}
+	if _, ok := p.listeners[local]; ok {
+		return true
+	}
+	_, ok := p.listeners[Endpoint{Addr: ip.AddrAny, Port: local.Port}]
+	return ok
+}
+
+// autobind fills the unspecified local endpoint of the pcb connecting to foreign,
+// the address of the interface to foreign and the ephemeral port are chosen.
+// mutex must be held by the caller.
+func (pcb *pcb) autobind(foreign Endpoint) error {
+	if pcb.local.Addr == ip.AddrAny {
+		route, err := pcb.proto.ip.LookupTable(foreign.Addr)
+		if err != nil {
+			return err
+		}
+		pcb.local.Addr = route.Iface.Unicast
+	}
+	if pcb.local.Port == 0 {
+		port, err := pcb.proto.ports.Allocate(pcb.local.Addr, foreign.Addr, foreign.Port, func(port uint16) bool {
+			return pcb.proto.portUsed(Endpoint{Addr: pcb.local.Addr, Port: port}, foreign)
+		})
+		if err != nil {
+			return err
+		}
+		pcb.local.Port = port
+		log.Printf("[D] TCP ephemeral port is assigned: local=%s,foreign=%s", pcb.local, foreign)
+	}
+	return nil
+}
@@ -1,14 +1,25 @@
 package tcp_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/hedwig100/go-network/pkg"
+	"github.com/hedwig100/go-network/pkg/arp"
 	"github.com/hedwig100/go-network/pkg/device"
 	"github.com/hedwig100/go-network/pkg/ip"
+	network "github.com/hedwig100/go-network/pkg/net"
 	"github.com/hedwig100/go-network/pkg/tcp"
+	"github.com/hedwig100/go-network/pkg/utils"
 )
 
 /*
@@ -47,10 +58,15 @@ const (
 func TestTCPActiveOpenClose(t *testing.T) {
 	var err error
 
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// devices
-	_ = device.NullInit("null0")
-	loop := device.LoopbackInit("loop0")
-	ether, err := device.EtherInit("tap0")
+	_ = device.NullInit(s.Net, "null0")
+	loop := device.LoopbackInit(s.Net, "loop0")
+	ether, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,31 +76,26 @@ func TestTCPActiveOpenClose(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(loop, iface0)
+	s.IP.IfaceRegister(loop, iface0)
 
 	iface1, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(ether, iface1)
+	s.IP.IfaceRegister(ether, iface1)
 
 	// default gateway
-	err = ip.SetDefaultGateway(iface1, defaultGateway)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = pkg.NetInit(false)
+	err = s.IP.SetDefaultGateway(iface1, defaultGateway)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pkg.NetRun()
+	s.Run()
 
 	src, _ := tcp.Str2Endpoint("192.0.2.2:8080")
 	dst, _ := tcp.Str2Endpoint("192.0.2.1:8080")
 
-	soc, err := tcp.Newpcb(src)
+	soc, err := s.TCP.Newpcb(src)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -123,7 +134,7 @@ func TestTCPActiveOpenClose(t *testing.T) {
 		}
 	}
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
@@ -133,10 +144,15 @@ func TestTCPActiveOpenClose(t *testing.T) {
 func TestTCPSend(t *testing.T) {
 	var err error
 
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// devices
-	_ = device.NullInit("null0")
-	loop := device.LoopbackInit("loop0")
-	ether, err := device.EtherInit("tap0")
+	_ = device.NullInit(s.Net, "null0")
+	loop := device.LoopbackInit(s.Net, "loop0")
+	ether, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -146,31 +162,26 @@ func TestTCPSend(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(loop, iface0)
+	s.IP.IfaceRegister(loop, iface0)
 
 	iface1, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(ether, iface1)
+	s.IP.IfaceRegister(ether, iface1)
 
 	// default gateway
-	err = ip.SetDefaultGateway(iface1, defaultGateway)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = pkg.NetInit(false)
+	err = s.IP.SetDefaultGateway(iface1, defaultGateway)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pkg.NetRun()
+	s.Run()
 
 	src, _ := tcp.Str2Endpoint("192.0.2.2:8080")
 	dst, _ := tcp.Str2Endpoint("192.0.2.1:8080")
 
-	soc, err := tcp.Newpcb(src)
+	soc, err := s.TCP.Newpcb(src)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -212,7 +223,7 @@ func TestTCPSend(t *testing.T) {
 		}
 	}
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
@@ -222,10 +233,15 @@ func TestTCPSend(t *testing.T) {
 func TestTCPPassiveOpen(t *testing.T) {
 	var err error
 
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// devices
-	_ = device.NullInit("null0")
-	loop := device.LoopbackInit("loop0")
-	ether, err := device.EtherInit("tap0")
+	_ = device.NullInit(s.Net, "null0")
+	loop := device.LoopbackInit(s.Net, "loop0")
+	ether, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -235,30 +251,25 @@ func TestTCPPassiveOpen(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(loop, iface0)
+	s.IP.IfaceRegister(loop, iface0)
 
 	iface1, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(ether, iface1)
+	s.IP.IfaceRegister(ether, iface1)
 
 	// default gateway
-	err = ip.SetDefaultGateway(iface1, defaultGateway)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = pkg.NetInit(false)
+	err = s.IP.SetDefaultGateway(iface1, defaultGateway)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pkg.NetRun()
+	s.Run()
 
 	src, _ := tcp.Str2Endpoint("192.0.2.2:8080")
 
-	soc, err := tcp.Newpcb(src)
+	soc, err := s.TCP.Newpcb(src)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -266,25 +277,27 @@ func TestTCPPassiveOpen(t *testing.T) {
 	errChOpen := make(chan error)
 	errChClose := make(chan error)
 	go soc.Open(errChOpen, tcp.Endpoint{}, false, 5*time.Minute)
+	if err = <-errChOpen; err != nil {
+		t.Fatal(err)
+	}
+	t.Log("open suceeded")
 
-	cnt := 1
+	conn, err := soc.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnt := 0
 	for {
-		if cnt == 0 && soc.Status() == tcp.PCBStateClosed {
+		if cnt == 0 && conn.Status() == tcp.PCBStateClosed {
 			break
 		}
-		if cnt == 0 && soc.Status() == tcp.PCBStateCloseWait {
-			go soc.Close(errChClose)
+		if cnt == 0 && conn.Status() == tcp.PCBStateCloseWait {
+			go conn.Close(errChClose)
 			cnt++
 		}
 
 		select {
-		case err = <-errChOpen:
-			cnt--
-			if err != nil {
-				t.Error(err)
-			} else {
-				t.Log("open suceeded")
-			}
 		case err = <-errChClose:
 			cnt--
 			if err != nil && err.Error() != "connection closed" { // passive close
@@ -297,7 +310,7 @@ func TestTCPPassiveOpen(t *testing.T) {
 		}
 	}
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
@@ -307,10 +320,15 @@ func TestTCPPassiveOpen(t *testing.T) {
 func TestTCPReceive(t *testing.T) {
 	var err error
 
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// devices
-	_ = device.NullInit("null0")
-	loop := device.LoopbackInit("loop0")
-	ether, err := device.EtherInit("tap0")
+	_ = device.NullInit(s.Net, "null0")
+	loop := device.LoopbackInit(s.Net, "loop0")
+	ether, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -320,30 +338,25 @@ func TestTCPReceive(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(loop, iface0)
+	s.IP.IfaceRegister(loop, iface0)
 
 	iface1, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(ether, iface1)
+	s.IP.IfaceRegister(ether, iface1)
 
 	// default gateway
-	err = ip.SetDefaultGateway(iface1, defaultGateway)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = pkg.NetInit(false)
+	err = s.IP.SetDefaultGateway(iface1, defaultGateway)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pkg.NetRun()
+	s.Run()
 
 	src, _ := tcp.Str2Endpoint("192.0.2.2:8080")
 
-	soc, err := tcp.Newpcb(src)
+	soc, err := s.TCP.Newpcb(src)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -354,28 +367,29 @@ func TestTCPReceive(t *testing.T) {
 	var n int
 
 	go soc.Open(errChOpen, tcp.Endpoint{}, false, 5*time.Minute)
-	time.Sleep(time.Millisecond)
+	if err = <-errChOpen; err != nil {
+		t.Fatal(err)
+	}
+	t.Log("open suceeded")
 
-	cnt := 1
+	conn, err := soc.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnt := 0
 	maxRcvTime := 5
 
 	for {
 		if cnt == 0 && maxRcvTime == 0 {
 			break
 		}
-		if cnt == 0 && soc.Status() == tcp.PCBStateEstablished {
-			go soc.Receive(errChRcv, buf, &n)
+		if cnt == 0 && conn.Status() == tcp.PCBStateEstablished {
+			go conn.Receive(errChRcv, buf, &n)
 			cnt++
 		}
 
 		select {
-		case err = <-errChOpen:
-			cnt--
-			if err != nil {
-				t.Error(err)
-			} else {
-				t.Log("open suceeded")
-			}
 		case err = <-errChRcv:
 			cnt--
 			maxRcvTime--
@@ -390,9 +404,1773 @@ func TestTCPReceive(t *testing.T) {
 		}
 	}
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+
+}
+
+// pipeStacks returns two stacks connected with the pipe device.
+// addresses of the stacks are etherTapIPAddr and defaultGateway.
+func pipeStacks(t *testing.T) (*pkg.Stack, *pkg.Stack) {
+	s0, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev0, dev1, err := device.PipeInit(s0.Net, "pipe0", s1.Net, "pipe1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iface0, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s0.IP.IfaceRegister(dev0, iface0); err != nil {
+		t.Fatal(err)
+	}
+
+	iface1, err := ip.NewIface(defaultGateway, etherTapNetmask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.IP.IfaceRegister(dev1, iface1); err != nil {
+		t.Fatal(err)
+	}
+
+	s0.Run()
+	s1.Run()
+	return s0, s1
+}
+
+// wait waits for the error of the user call
+func wait(t *testing.T, errCh chan error) error {
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("user call timeout")
+	}
+	return nil
+}
+
+// scriptedPeer is the TCP peer scripted by the test, which is the other end of the pipe device.
+// The address of the peer is defaultGateway and the one of the stack is etherTapIPAddr.
+type scriptedPeer struct {
+	t    *testing.T
+	pipe *device.Pipe
+	dev  *device.Pipe
+}
+
+// peerStack returns the stack connected with the scripted peer,
+// the stack learns the hardware address of the peer in advance.
+func peerStack(t *testing.T) (*pkg.Stack, *scriptedPeer) {
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, pipe, err := device.PipeInit(s.Net, "pipe0", nil, "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iface, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.IP.IfaceRegister(dev, iface); err != nil {
+		t.Fatal(err)
+	}
+	s.Run()
+
+	// ARP request from the peer
+	peerAddr, _ := ip.Str2Addr(defaultGateway)
+	var w bytes.Buffer
+	binary.Write(&w, binary.BigEndian, arp.ArpEther{
+		Header: arp.Header{Hrd: 0x0001, Pro: 0x0800, Hln: device.EtherAddrLen, Pln: ip.AddrLen, Op: 1},
+		Sha:    pipe.EtherAddr,
+		Spa:    ip.Addr(peerAddr),
+		Tha:    device.EtherAddrAny,
+		Tpa:    iface.Unicast,
+	})
+	if err = pipe.TxHandler(w.Bytes(), network.ProtoTypeArp, device.EtherAddrBroadcast); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = pipe.Recv(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return s, &scriptedPeer{t: t, pipe: pipe, dev: dev}
+}
+
+// send sends the segment from the peer to the stack
+func (p *scriptedPeer) send(src tcp.Endpoint, dst tcp.Endpoint, seq uint32, ack uint32, flag tcp.ControlFlag, wnd uint16, payload []byte) {
+	seg := tcpSegment(src, dst, seq, ack, flag, wnd, payload)
+	hdr := ip.Header{
+		Vhl:       ip.V4<<4 | ip.HeaderSizeMin>>2,
+		Tol:       uint16(ip.HeaderSizeMin + len(seg)),
+		Ttl:       64,
+		ProtoType: ip.ProtoTCP,
+		Src:       src.Addr,
+		Dst:       dst.Addr,
+	}
+	var w bytes.Buffer
+	binary.Write(&w, binary.BigEndian, hdr)
+	w.Write(seg)
+	packet := w.Bytes()
+	copy(packet[10:12], utils.Hton16(utils.CheckSum(packet[:ip.HeaderSizeMin], 0)))
+	if err := p.pipe.TxHandler(packet, network.ProtoTypeIP, p.dev.EtherAddr); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// recv returns the next TCP segment sent by the stack, the other frames are skipped
+func (p *scriptedPeer) recv(timeout time.Duration) (tcp.Header, []byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ether, packet, err := p.pipe.Recv(time.Until(deadline))
+		if err != nil {
+			return tcp.Header{}, nil, err
+		}
+		if ether.Type != network.ProtoTypeIP || len(packet) < ip.HeaderSizeMin || ip.ProtoType(packet[9]) != ip.ProtoTCP {
+			continue
+		}
+
+		// the frame may be padded
+		packet = packet[:binary.BigEndian.Uint16(packet[2:4])]
+		seg := packet[int(packet[0]&0x0f)<<2:]
+		var hdr tcp.Header
+		binary.Read(bytes.NewReader(seg), binary.BigEndian, &hdr)
+		return hdr, seg[int(hdr.Offset>>4)<<2:], nil
+	}
+}
+
+// accept makes the connection from foreign to the listener at local by the three-way handshake
+// of the peer, and returns the accepted connection and the ISS of the stack.
+func (p *scriptedPeer) accept(ln *tcp.Listener, local tcp.Endpoint, foreign tcp.Endpoint, irs uint32) (net.Conn, uint32) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			p.t.Error(err)
+			return
+		}
+		accepted <- conn
+	}()
+
+	p.send(foreign, local, irs, 0, tcp.SYN, 0xffff, nil)
+	synack, _, err := p.recv(time.Second)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if synack.Flag != tcp.SYN|tcp.ACK || synack.Ack != irs+1 {
+		p.t.Fatalf("unexpected SYN-ACK %s", synack)
+	}
+	p.send(foreign, local, irs+1, synack.Seq+1, tcp.ACK, 0xffff, nil)
+
+	select {
+	case conn := <-accepted:
+		return conn, synack.Seq
+	case <-time.After(5 * time.Second):
+		p.t.Fatal("timeout")
+	}
+	return nil, 0
+}
+
+/*
+
+go test -v ./pkg/tcp -run TestTCPPipe
+
+two stacks connected with the pipe device open a connection,
+exchange data and close it
+
+*/
+
+func TestTCPPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	src, _ := tcp.Str2Endpoint("192.0.2.2:49152")
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8080")
+
+	server, err := s1.TCP.Newpcb(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := s0.TCP.Newpcb(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errServer := make(chan error, 1)
+	errClient := make(chan error, 1)
+
+	// three way handshake
+	server.Open(errServer, tcp.Endpoint{}, false, time.Minute)
+	if err = wait(t, errServer); err != nil {
+		t.Fatal(err)
+	}
+	client.Open(errClient, dst, true, time.Minute)
+	if err = wait(t, errClient); err != nil {
+		t.Fatal(err)
+	}
+	if client.Status() != tcp.PCBStateEstablished {
+		t.Fatalf("client state is %s", client.Status())
+	}
+	listener := server
+	server, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// data transfer
+	buf := make([]byte, 100)
+	var n int
+	for i := 0; i < 5; i++ {
+		msg := fmt.Sprintf("TCP connection%d !!!!\n", i)
+		client.Send(errClient, []byte(msg))
+		if err = wait(t, errClient); err != nil {
+			t.Fatal(err)
+		}
+
+		server.Receive(errServer, buf, &n)
+		if err = wait(t, errServer); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Errorf("received %q, want %q", buf[:n], msg)
+		}
+	}
+
+	// close
+	client.Close(errClient)
+	for i := 0; i < 100 && server.Status() != tcp.PCBStateCloseWait; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.Status() != tcp.PCBStateCloseWait {
+		t.Fatalf("server state is %s", server.Status())
+	}
+	server.Close(errServer)
+	if err = wait(t, errServer); err != nil && err.Error() != "connection closed" {
+		t.Error(err)
+	}
+	if err = wait(t, errClient); err != nil {
+		t.Error(err)
+	}
+	if client.Status() != tcp.PCBStateTimeWait {
+		t.Errorf("client state is %s", client.Status())
+	}
+	if listener.Status() != tcp.PCBStateListen {
+		t.Errorf("listener state is %s", listener.Status())
+	}
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPConnPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	src, _ := tcp.Str2Endpoint("192.0.2.2:49153")
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8081")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if server == nil {
+		t.FailNow()
+	}
+	if server.RemoteAddr().String() != src.String() {
+		t.Errorf("remote address is %s, want %s", server.RemoteAddr(), src)
+	}
+
+	// data transfer
+	msg := "TCP connection by net.Conn !!!!\n"
+	if _, err = client.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(server).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != msg {
+		t.Errorf("received %q, want %q", line, msg)
+	}
+
+	// read deadline
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = server.Read(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("error is %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	server.SetReadDeadline(time.Time{})
+
+	// close
+	if err = client.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err = io.ReadAll(server); err != nil {
+		t.Error(err)
+	}
+	if err = server.Close(); err != nil {
+		t.Error(err)
+	}
+	if err = ln.Close(); err != nil {
+		t.Error(err)
+	}
+
+	err = s0.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPAcceptPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8082")
+
+	listener, err := s1.TCP.Newpcb(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = listener.SetBacklog(2); err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	listener.Open(errCh, tcp.Endpoint{}, false, time.Minute)
+	if err = wait(t, errCh); err != nil {
+		t.Fatal(err)
+	}
 
+	// three clients connect to the same port, the last one is not answered
+	// because the backlog is full.
+	var errClients []chan error
+	for i := 0; i < 3; i++ {
+		src, _ := tcp.Str2Endpoint(fmt.Sprintf("192.0.2.2:%d", 49160+i))
+		client, err := s0.TCP.Newpcb(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errClient := make(chan error, 1)
+		client.Open(errClient, dst, true, time.Minute)
+		errClients = append(errClients, errClient)
+	}
+	for i := 0; i < 2; i++ {
+		if err = wait(t, errClients[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err = <-errClients[2]:
+		t.Errorf("the connection over the backlog is established, err=%v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Status() != tcp.PCBStateEstablished {
+			t.Errorf("connection state is %s", conn.Status())
+		}
+	}
+
+	// closing the listener resets the connections not accepted yet
+	listener.Close(errCh)
+	if err = wait(t, errCh); err != nil {
+		t.Error(err)
+	}
+	if _, err = listener.Accept(); err == nil {
+		t.Error("closed listener accepted the connection")
+	}
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPListenerPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8083")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// echo server
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+
+	// clients talk to the server at the same time
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const clients = 4
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		go func(i int) {
+			src, _ := tcp.Str2Endpoint(fmt.Sprintf("192.0.2.2:%d", 49170+i))
+			conn, err := s0.TCP.Dial(ctx, src, dst)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			msg := fmt.Sprintf("hello from client%d\n", i)
+			if _, err = conn.Write([]byte(msg)); err != nil {
+				errs <- err
+				return
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				errs <- err
+				return
+			}
+			if line != msg {
+				errs <- fmt.Errorf("received %q, want %q", line, msg)
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < clients; i++ {
+		select {
+		case err = <-errs:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	if err = ln.Close(); err != nil {
+		t.Error(err)
+	}
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPSegmentPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	src, _ := tcp.Str2Endpoint("192.0.2.2:49180")
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8084")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the data larger than MTU is segmentized
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(data))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Error(err)
+		}
+		received <- buf
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err = client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case buf := <-received:
+		if !bytes.Equal(buf, data) {
+			t.Error("received data is different from the sent one")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	client.Close()
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPZeroWindowPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	src, _ := tcp.Str2Endpoint("192.0.2.2:49181")
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8085")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the data larger than the receive window of the foreign
+	data := make([]byte, 400000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			received <- nil
+			return
+		}
+		defer conn.Close()
+
+		// the slow reader keeps the window closed longer than maxRetxCount (8) RTOs,
+		// the connection survives because the window probes are acknowledged
+		time.Sleep(9 * time.Second)
+		buf := make([]byte, len(data))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Error(err)
+		}
+		received <- buf
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetWriteDeadline(time.Now().Add(20 * time.Second))
+	if _, err = client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case buf := <-received:
+		if !bytes.Equal(buf, data) {
+			t.Error("received data is different from the sent one")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	client.Close()
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPKeepAlivePipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	src, _ := tcp.Str2Endpoint("192.0.2.2:49182")
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8086")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SetKeepAliveConfig(tcp.KeepAliveConfig{
+		Enable:   true,
+		Idle:     time.Second,
+		Interval: time.Second,
+		Count:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the probes are answered while the foreign is alive
+	buf := make([]byte, 10)
+	client.SetReadDeadline(time.Now().Add(3500 * time.Millisecond))
+	if _, err = client.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection is broken while the foreign is alive: %v", err)
+	}
+
+	// the foreign is gone without closing the connection
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err = client.Read(buf); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("connection is not aborted: %v", err)
+	}
+
+	client.Close()
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPStreamPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	src, _ := tcp.Str2Endpoint("192.0.2.2:49183")
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8087")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the data much larger than the send buffer
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(data))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Error(err)
+		}
+		received <- buf
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.SetWriteBuffer(8192); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write blocks while the buffer is full and returns after all of the data is buffered
+	client.SetWriteDeadline(time.Now().Add(20 * time.Second))
+	for sent := 0; sent < len(data); sent += 10000 {
+		end := sent + 10000
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := client.Write(data[sent:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != end-sent {
+			t.Fatalf("written %d bytes, want %d", n, end-sent)
+		}
+	}
+
+	select {
+	case buf := <-received:
+		if !bytes.Equal(buf, data) {
+			t.Error("received data is different from the sent one")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	client.Close()
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPWildcardPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	// listen on every address and dial without the local endpoint
+	wildcard, _ := tcp.Str2Endpoint("0.0.0.0:8088")
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8088")
+
+	ln, err := s1.TCP.Listen(wildcard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var clients [2]*tcp.Conn
+	for i := range clients {
+		clients[i], err = s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		local := clients[i].LocalAddr().(tcp.Addr)
+		if local.Addr.String() != "192.0.2.2" || local.Port < 49152 {
+			t.Errorf("local address is %s, want 192.0.2.2 and the ephemeral port", local)
+		}
+
+		var server net.Conn
+		select {
+		case server = <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		if server.LocalAddr().String() != dst.String() {
+			t.Errorf("local address of the server is %s, want %s", server.LocalAddr(), dst)
+		}
+		if server.RemoteAddr().String() != local.String() {
+			t.Errorf("remote address of the server is %s, want %s", server.RemoteAddr(), local)
+		}
+
+		// data transfer
+		msg := fmt.Sprintf("hello%d\n", i)
+		if _, err = clients[i].Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(server).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != msg {
+			t.Errorf("received %q, want %q", line, msg)
+		}
+		server.Close()
+	}
+	if clients[0].LocalAddr().String() == clients[1].LocalAddr().String() {
+		t.Errorf("the same local address %s is used twice", clients[0].LocalAddr())
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPRefusedPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	// nobody listens on dst, so the reset is replied to SYN
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8089")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err == nil {
+		t.Fatal("connection to the closed port is established")
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("connection to the closed port is not reset")
+	}
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPSYNCookiePipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8090")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.SetSYNCookies(true)
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// the first connection resolves the hardware addresses
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, err := s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// SYN flood from the address which does not answer fills the backlog
+	iface, err := ip.NewIface(defaultGateway, etherTapNetmask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _ := tcp.Str2Endpoint("192.0.2.3:40000")
+	for i := 0; i < 16; i++ {
+		src.Port++
+		s1.TCP.RxHandler(synSegment(src, dst, uint32(i)), src.Addr, dst.Addr, iface)
+	}
+
+	// the connection is established by SYN cookie
+	client, err := s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	msg := "connection by SYN cookie\n"
+	if _, err = client.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(server).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != msg {
+		t.Errorf("received %q, want %q", line, msg)
+	}
+
+	client.Close()
+	server.Close()
+	first.Close()
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// synSegment returns SYN segment from src to dst, which is given to RxHandler directly
+func synSegment(src tcp.Endpoint, dst tcp.Endpoint, seq uint32) []byte {
+	return tcpSegment(src, dst, seq, 0, tcp.SYN, 0xffff, nil)
+}
+
+// tcpSegment returns the TCP segment without options, whose checksum is calculated
+func tcpSegment(src tcp.Endpoint, dst tcp.Endpoint, seq uint32, ack uint32, flag tcp.ControlFlag, wnd uint16, payload []byte) []byte {
+	hdr := tcp.Header{
+		Src:    src.Port,
+		Dst:    dst.Port,
+		Seq:    seq,
+		Ack:    ack,
+		Offset: tcp.HeaderSizeMin >> 2 << 4,
+		Flag:   flag,
+		Window: wnd,
+	}
+	pseudoHdr := tcp.PseudoHeader{
+		Src:  src.Addr,
+		Dst:  dst.Addr,
+		Type: ip.ProtoTCP,
+		Len:  uint16(tcp.HeaderSizeMin + len(payload)),
+	}
+	var w bytes.Buffer
+	binary.Write(&w, binary.BigEndian, pseudoHdr)
+	binary.Write(&w, binary.BigEndian, hdr)
+	w.Write(payload)
+	buf := w.Bytes()
+	copy(buf[28:30], utils.Hton16(utils.CheckSum(buf, 0)))
+	return buf[tcp.PseudoHeaderSize:]
+}
+
+func TestTCPSYNCookieAcceptQueuePipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8097")
+
+	listener, err := s1.TCP.Newpcb(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = listener.SetBacklog(1); err != nil {
+		t.Fatal(err)
+	}
+	listener.SetSYNCookies(true)
+	errCh := make(chan error, 1)
+	listener.Open(errCh, tcp.Endpoint{}, false, time.Minute)
+	if err = wait(t, errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first connection fills the accept queue
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	first, err := s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the ACK returning the SYN cookie is dropped while the queue is full,
+	// the client is not reset
+	client, err := s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if state := client.Info().State; state != tcp.PCBStateEstablished {
+		t.Fatalf("client state is %s, want ESTABLISHED", state)
+	}
+
+	// after the queue has room, the retransmitted data establishes the connection
+	if _, err = listener.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	msg := "connection by SYN cookie\n"
+	if _, err = client.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500 && server.Info().BytesReceived < uint64(len(msg)); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received := server.Info().BytesReceived; received != uint64(len(msg)) {
+		t.Errorf("received %d bytes, want %d", received, len(msg))
+	}
+
+	client.Close()
+	first.Close()
+	listener.Close(errCh)
+	if err = wait(t, errCh); err != nil {
+		t.Error(err)
+	}
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPHalfClosePipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8091")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *tcp.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn.(*tcp.Conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server *tcp.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// the client sends the request and shuts down the sending side,
+	// the server reads it until EOF and replies on the same connection
+	if _, err = client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write([]byte("more")); err == nil {
+		t.Error("data can be written after CloseWrite")
+	}
+	req, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req) != "request" {
+		t.Errorf("received %q, want %q", req, "request")
+	}
+	if _, err = server.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server shuts down the receiving side after the response is read,
+	// the data arriving afterwards is discarded but the client can close gracefully
+	buf := make([]byte, 8)
+	if _, err = io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "response" {
+		t.Errorf("received %q, want %q", buf, "response")
+	}
+	if err = server.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := server.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("Read after CloseRead returns (%d,%v), want (0,EOF)", n, err)
+	}
+
+	server.SetLinger(5)
+	if err = server.Close(); err != nil {
+		t.Errorf("graceful close with linger failed: %v", err)
+	}
+	if _, err = io.ReadAll(client); err != nil {
+		t.Error(err)
+	}
+	client.Close()
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPLingerPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8092")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// the zero linger resets the connection on Close instead of sending FIN
+	client.SetLinger(0)
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = server.Read(make([]byte, 16))
+	if err == nil || err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read after the abortive close returns %v, want the reset", err)
+	}
+
+	server.Close()
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPUrgentPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8093")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *tcp.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn.(*tcp.Conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server *tcp.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// the interrupt is sent as the urgent data in the middle of the stream
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.WriteUrgent([]byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	oob := make([]byte, 1)
+	if _, err = server.ReadUrgent(oob); err != nil {
+		t.Fatal(err)
+	}
+	if oob[0] != '!' {
+		t.Errorf("urgent data is %q, want %q", oob, "!")
+	}
+
+	// the urgent data is taken out of the stream, the mark is after "hello"
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" || !server.AtMark() {
+		t.Errorf("received %q before the mark, at mark %v", buf, server.AtMark())
+	}
+	if _, err = io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "world" {
+		t.Errorf("received %q after the mark", buf)
+	}
+
+	client.Close()
+	server.Close()
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPInfoPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8094")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *tcp.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn.(*tcp.Conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server *tcp.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if _, err = client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(server, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// every data is acknowledged soon after the server reads it
+	var info tcp.Info
+	for i := 0; i < 50; i++ {
+		info = client.Info()
+		if info.BytesInFlight == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info.State != tcp.PCBStateEstablished || info.Foreign != dst {
+		t.Errorf("state=%s,foreign=%s", info.State, info.Foreign)
+	}
+	if info.BytesInFlight != 0 || info.SndUna != info.SndNxt {
+		t.Errorf("data is not acknowledged: %s", info)
+	}
+	if info.BytesSent < uint64(len(data)) || info.Cwnd == 0 || info.RTO == 0 {
+		t.Errorf("unexpected statistics: %s", info)
+	}
+	if received := server.Info().BytesReceived; received != uint64(len(data)) {
+		t.Errorf("server received %d bytes, want %d", received, len(data))
+	}
+
+	// the listening pcb and the accepted one are listed
+	var listening, established bool
+	for _, c := range s1.TCP.Connections() {
+		switch {
+		case c.State == tcp.PCBStateListen && c.Local == dst:
+			listening = true
+		case c.State == tcp.PCBStateEstablished && c.Foreign == info.Local:
+			established = true
+		}
+	}
+	if !listening || !established {
+		t.Errorf("connections are not listed listening=%v,established=%v", listening, established)
+	}
+
+	client.Close()
+	server.Close()
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPDialCancelPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8095")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	// the pcb opened by Dial is deleted even if the context is done before SYN is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = s0.TCP.Dial(ctx, tcp.Endpoint{}, dst); !errors.Is(err, context.Canceled) {
+		t.Errorf("Dial returns %v, want %v", err, context.Canceled)
+	}
+	if conns := s0.TCP.Connections(); len(conns) != 0 {
+		t.Errorf("pcbs remain after Dial is canceled: %v", conns)
+	}
+	select {
+	case conn := <-accepted:
+		t.Errorf("the connection from %s is established after Dial is canceled", conn.RemoteAddr())
+	case <-time.After(200 * time.Millisecond):
+	}
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPSimultaneousClosePipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+	dst, _ := tcp.Str2Endpoint("192.0.2.1:8096")
+
+	ln, err := s1.TCP.Listen(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *tcp.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn.(*tcp.Conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := s0.TCP.Dial(ctx, tcp.Endpoint{}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server *tcp.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// the data more than the window of the server remains in the send buffer,
+	// so FIN of the client is queued behind it when both sides close
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	client.SetWriteBuffer(2 * len(data))
+	if _, err = client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client sends FIN after all of the data even if it enters CLOSING,
+	// it does not enter TIME-WAIT until the server acknowledges FIN after the data
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var received []byte
+	buf := make([]byte, 1000)
+	for {
+		n, err := server.Read(buf)
+		received = append(received, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := client.Info().State
+		if state == tcp.PCBStateTimeWait && server.Info().BytesReceived < uint64(len(data)) {
+			t.Fatalf("the client enters TIME-WAIT before all of the data is received")
+		}
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %d bytes, want %d", len(received), len(data))
+	}
+
+	server.Close()
+	ln.Close()
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPRTORecoveryPipe(t *testing.T) {
+	var err error
+
+	s, peer := peerStack(t)
+
+	local, _ := tcp.Str2Endpoint("192.0.2.2:8098")
+	foreign, _ := tcp.Str2Endpoint("192.0.2.1:40000")
+
+	ln, err := s.TCP.Listen(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, iss := peer.accept(ln, local, foreign, 1000)
+
+	// the initial window (four segments of the default MSS) is sent and all of them are lost
+	const mss = 536
+	if _, err = conn.Write(make([]byte, 4*mss)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, _, err = peer.recv(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest one is retransmitted by the timeout
+	hdr, _, err := peer.recv(3 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Seq != iss+1 {
+		t.Fatalf("retransmitted seq=%d, want %d", hdr.Seq, iss+1)
+	}
+
+	// the next one is retransmitted as soon as the retransmission is acknowledged,
+	// without waiting for another timeout
+	peer.send(foreign, local, 1001, iss+1+mss, tcp.ACK, 0xffff, nil)
+	hdr, _, err = peer.recv(500 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Seq != iss+1+mss {
+		t.Errorf("retransmitted seq=%d, want %d", hdr.Seq, iss+1+mss)
+	}
+
+	ln.Close()
+	err = s.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPZeroWindowProbePipe(t *testing.T) {
+	var err error
+
+	s, peer := peerStack(t)
+
+	local, _ := tcp.Str2Endpoint("192.0.2.2:8099")
+	foreign, _ := tcp.Str2Endpoint("192.0.2.1:40000")
+
+	ln, err := s.TCP.Listen(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, iss := peer.accept(ln, local, foreign, 1000)
+
+	const mss = 536
+	if _, err = conn.Write(make([]byte, 2*mss)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err = peer.recv(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the window is closed with the second segment outstanding,
+	// the window is probed instead of retransmitting the segment
+	una := iss + 1 + mss
+	peer.send(foreign, local, 1001, una, tcp.ACK, 0, nil)
+	for i := 0; i < 2; i++ {
+		hdr, payload, err := peer.recv(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Seq != una-1 || len(payload) != 0 {
+			t.Fatalf("seq=%d,len=%d is sent, want the window probe", hdr.Seq, len(payload))
+		}
+		peer.send(foreign, local, 1001, una, tcp.ACK, 0, nil)
+	}
+
+	// the segment is retransmitted after the window opens
+	peer.send(foreign, local, 1001, una, tcp.ACK, 0xffff, nil)
+	hdr, payload, err := peer.recv(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Seq != una || len(payload) != mss {
+		t.Errorf("seq=%d,len=%d is sent, want seq=%d,len=%d", hdr.Seq, len(payload), una, mss)
+	}
+
+	ln.Close()
+	err = s.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCPKeepAliveOffPathPipe(t *testing.T) {
+	var err error
+
+	s, peer := peerStack(t)
+
+	local, _ := tcp.Str2Endpoint("192.0.2.2:8100")
+	foreign, _ := tcp.Str2Endpoint("192.0.2.1:40000")
+
+	ln, err := s.TCP.Listen(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := peer.accept(ln, local, foreign, 1000)
+	err = conn.(*tcp.Conn).SetKeepAliveConfig(tcp.KeepAliveConfig{
+		Enable:   true,
+		Idle:     time.Second,
+		Interval: time.Second,
+		Count:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(8 * time.Second))
+		_, err := conn.Read(make([]byte, 10))
+		readErr <- err
+	}()
+
+	// the foreign does not answer the probes, SYN and RST in the window answered with
+	// the challenge ACK (which the off-path attacker can send) do not keep the connection alive
+	for {
+		select {
+		case err = <-readErr:
+			if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("connection is not aborted: %v", err)
+			}
+			ln.Close()
+			if err = s.Shutdown(); err != nil {
+				t.Error(err)
+			}
+			return
+		case <-time.After(300 * time.Millisecond):
+			peer.send(foreign, local, 1001, 0, tcp.SYN, 0xffff, nil)
+			peer.send(foreign, local, 1101, 0, tcp.RST, 0xffff, nil)
+		}
+	}
+}
+
+func TestTCPFinWait2TimeoutPipe(t *testing.T) {
+	var err error
+
+	s, peer := peerStack(t)
+	s.TCP.SetFinTimeout(time.Second)
+
+	local, _ := tcp.Str2Endpoint("192.0.2.2:8101")
+	foreign, _ := tcp.Str2Endpoint("192.0.2.1:40000")
+
+	ln, err := s.TCP.Listen(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, iss := peer.accept(ln, local, foreign, 1000)
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// FIN is acknowledged but the foreign never sends its FIN
+	fin, _, err := peer.recv(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fin.Flag&tcp.FIN == 0 || fin.Seq != iss+1 {
+		t.Fatalf("unexpected segment %s", fin)
+	}
+	peer.send(foreign, local, 1001, iss+2, tcp.ACK, 0xffff, nil)
+
+	// the orphaned connection is reset after the timeout
+	rst, _, err := peer.recv(3 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst.Flag&tcp.RST == 0 {
+		t.Errorf("unexpected segment %s", rst)
+	}
+	for _, c := range s.TCP.Connections() {
+		if c.Foreign == foreign {
+			t.Errorf("the connection remains: %v", c)
+		}
+	}
+
+	ln.Close()
+	err = s.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
 }
@@ -1,7 +1,6 @@
 package tcp
 
 import (
-	"fmt"
 	"log"
 	"time"
 )
@@ -15,89 +14,423 @@ const (
 	lbound time.Duration = time.Second      // 1s
 	ubound time.Duration = 60 * time.Second // 60s
 
+	// RTO before the first RTT measurement (RFC6298)
+	initialRTO time.Duration = time.Second
+
+	// tick of the timer wheel, which is the clock granularity G in RFC6298
+	timerInterval time.Duration = time.Millisecond
+
+	// the data which could not be sent (e.g. the address is not resolved yet) is sent again after this time
+	outputRetryInterval time.Duration = 200 * time.Millisecond
+
+	// the ACK is delayed at most this time (RFC1122)
+	delayedAckTimeout time.Duration = 200 * time.Millisecond
+
 	MSL time.Duration = 2 * time.Minute
-)
 
-var (
-	// smoothed round trip time
-	srtt time.Duration = 10 * time.Second
+	// the closed connection waits for FIN of the foreign in FIN-WAIT-2 at most this time by default
+	defaultFinTimeout time.Duration = 60 * time.Second
+
+	// keepalive parameters used by default (RFC1122)
+	defaultKeepAliveIdle     time.Duration = 2 * time.Hour
+	defaultKeepAliveInterval time.Duration = 75 * time.Second
+	defaultKeepAliveCount                  = 9
 
-	// the retransmission timeout
-	rto time.Duration = 10 * time.Second
+	// the resets sent per second for the segments which no connection has
+	rstRateLimit = 100
+
+	// the challenge ACKs sent per second (RFC5961)
+	challengeAckLimit = 1000
 )
 
-func calculateRTO(rtt time.Duration) {
-	// ALPHA = 0.7
-	// BETA = 1.7
-	srtt = 7*srtt/10 + 3*rtt/10
-	if lbound > 17*srtt/10 {
-		rto = lbound
-	} else if ubound < 17*srtt/10 {
-		rto = ubound
+// KeepAliveConfig is the parameters of TCP keepalive.
+// The probe is sent after the connection is idle for Idle,
+// and then every Interval until the foreign answers.
+// The connection is aborted if Count probes are not answered.
+type KeepAliveConfig struct {
+	Enable   bool
+	Idle     time.Duration
+	Interval time.Duration
+	Count    int
+}
+
+// SetFinTimeout sets how long the connection closed by the user waits for FIN of the foreign
+// in FIN-WAIT-2 before it is aborted, it is defaultFinTimeout by default.
+func (p *Proto) SetFinTimeout(d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.finTimeout = d
+}
+
+// rateLimiter is a token bucket, which allows rate events per second and at most burst events at once.
+type rateLimiter struct {
+	rate   int
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether the event at now is allowed and consumes a token if so
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l.last.IsZero() {
+		l.tokens = float64(l.burst)
 	} else {
-		rto = 17 * srtt / 10
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
 	}
-	log.Printf("[I] RTT=%s,RTO=%s", rtt, rto)
+	l.tokens--
+	return true
 }
 
-func tcpTimer(done chan struct{}) {
+// updateRTO calculates SRTT,RTTVAR and RTO of the pcb from the RTT measurement (RFC6298).
+// ALPHA = 1/8, BETA = 1/4, K = 4
+func (pcb *pcb) updateRTO(rtt time.Duration) {
+	if pcb.srtt == 0 { // first measurement
+		pcb.srtt = rtt
+		pcb.rttvar = rtt / 2
+	} else {
+		diff := pcb.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		pcb.rttvar = 3*pcb.rttvar/4 + diff/4
+		pcb.srtt = 7*pcb.srtt/8 + rtt/8
+	}
 
-	for {
+	k := 4 * pcb.rttvar
+	if k < timerInterval {
+		k = timerInterval
+	}
+	pcb.rto = boundRTO(pcb.srtt + k)
+	log.Printf("[I] local=%s,RTT=%s,SRTT=%s,RTTVAR=%s,RTO=%s", pcb.local, rtt, pcb.srtt, pcb.rttvar, pcb.rto)
+}
 
-		// check if process finishes or not
-		select {
-		case <-done:
-			return
+// currentRTO returns RTO of the connection, which is initialRTO until RTT is measured
+func (pcb *pcb) currentRTO() time.Duration {
+	if pcb.rto == 0 {
+		return initialRTO
+	}
+	return pcb.rto
+}
+
+// retxTimeout returns the timeout of the entry, which is doubled every retransmission
+func (pcb *pcb) retxTimeout(entry *retxEntry) time.Duration {
+	rto := pcb.currentRTO()
+	for i := uint8(0); i < entry.retxCount && rto < ubound; i++ {
+		rto *= 2
+	}
+	return boundRTO(rto)
+}
+
+// delayAck acknowledges the segment in sequence. The ACK is sent for every second segment,
+// otherwise it is delayed so that it is piggybacked on the data sent by the user.
+// mutex must be held by the caller.
+func (pcb *pcb) delayAck() error {
+	pcb.ackPending++
+	if pcb.ackPending >= 2 {
+		return TxHelperTCP(pcb, ACK, []byte{}, 0, nil)
+	}
+	pcb.ackDue = time.Now().Add(delayedAckTimeout)
+	pcb.rearm()
+	return nil
+}
+
+// persist sends the window probe while the foreign advertises the zero window and
+// the data is waiting to be sent or acknowledged. The interval is doubled every probe, and
+// the connection is not aborted however long the window is closed.
+// mutex must be held by the caller.
+func (pcb *pcb) persist() {
+	// the retransmission timer stops and the probe is sent instead while the window is closed
+	if !pcb.zeroWindow() || (len(pcb.txQueue) == 0 && len(pcb.retxQueue) == 0) {
+		pcb.persistCount = 0
+		pcb.persistNext = time.Time{}
+		return
+	}
+
+	interval := pcb.retxTimeout(&retxEntry{retxCount: pcb.persistCount})
+	if pcb.persistNext.IsZero() {
+		pcb.persistNext = time.Now().Add(interval)
+		return
+	}
+	if time.Now().Before(pcb.persistNext) {
+		return
+	}
+
+	// the probe has the old sequence number, which makes the foreign
+	// send ACK with the current window without accepting any data
+	log.Printf("[D] TCP window probe local=%s,foreign=%s,count=%d", pcb.local, pcb.foreign, pcb.persistCount)
+	if err := pcb.transmit(pcb.snd.una-1, ACK, []byte{}); err != nil {
+		log.Printf("[E] TCP window probe error %s", err.Error())
+	}
+	if pcb.persistCount < maxRetxCount {
+		pcb.persistCount++
+	}
+	pcb.persistNext = time.Now().Add(pcb.retxTimeout(&retxEntry{retxCount: pcb.persistCount}))
+}
+
+// zeroWindow reports whether the foreign advertises the zero window,
+// the window is not known until the connection is synchronized.
+func (pcb *pcb) zeroWindow() bool {
+	return pcb.snd.wnd == 0 && pcb.state != PCBStateSYNSent && pcb.state != PCBStateSYNReceived
+}
+
+// keepalive sends the keepalive probe when the connection is idle and
+// aborts the connection if the foreign does not answer the probes.
+// It returns true if the connection is aborted. mutex must be held by the caller.
+func (pcb *pcb) keepalive() bool {
+	if !pcb.keepAlive.Enable {
+		return false
+	}
+	switch pcb.state {
+	case PCBStateEstablished, PCBStateCloseWait:
+	default:
+		return false
+	}
+
+	// the other timers work while data is waiting to be sent or acknowledged
+	if len(pcb.retxQueue) > 0 || len(pcb.txQueue) > 0 {
+		pcb.keepProbes = 0
+		pcb.keepNext = time.Time{}
+		return false
+	}
+
+	now := time.Now()
+	if pcb.lastRxTime.IsZero() {
+		pcb.lastRxTime = now
+	}
+	if pcb.keepProbes == 0 && now.Before(pcb.lastRxTime.Add(pcb.keepAlive.Idle)) {
+		return false
+	}
+	if pcb.keepProbes > 0 && now.Before(pcb.keepNext) {
+		return false
+	}
+
+	if pcb.keepProbes >= pcb.keepAlive.Count {
+		log.Printf("[D] TCP keepalive timeout local=%s,foreign=%s", pcb.local, pcb.foreign)
+		pcb.signalErr("connection timed out")
+		pcb.transition(PCBStateClosed)
+		if err := pcb.proto.TxHandler(pcb.local, pcb.foreign, []byte{}, pcb.snd.nxt, 0, RST, 0, 0); err != nil {
+			log.Printf("[E] TCP keepalive error %s", err.Error())
+		}
+		return true
+	}
+
+	// the probe has the sequence number already acknowledged,
+	// which makes the foreign send ACK (RFC1122)
+	if err := pcb.transmit(pcb.snd.nxt-1, ACK, []byte{}); err != nil {
+		log.Printf("[E] TCP keepalive error %s", err.Error())
+	}
+	pcb.keepProbes++
+	pcb.keepNext = now.Add(pcb.keepAlive.Interval)
+	return false
+}
+
+func boundRTO(rto time.Duration) time.Duration {
+	if rto < lbound {
+		return lbound
+	}
+	if rto > ubound {
+		return ubound
+	}
+	return rto
+}
+
+// nextTimeout returns the earliest time when any of the timers of the pcb expires,
+// false is returned if no timer works. mutex must be held by the caller.
+func (pcb *pcb) nextTimeout() (time.Time, bool) {
+	var due time.Time
+	earlier := func(t time.Time) {
+		if due.IsZero() || t.Before(due) {
+			due = t
+		}
+	}
+
+	switch pcb.state {
+	case PCBStateClosed, PCBStateListen:
+		return due, false
+	case PCBStateTimeWait:
+		return pcb.lastTxTime.Add(MSL), true
+	}
+
+	// the user no longer has the connection, the foreign may never send FIN
+	if pcb.release && pcb.state == PCBStateFINWait2 {
+		earlier(pcb.finWait2Time.Add(pcb.proto.finTimeout))
+	}
+
+	// user timeout and retransmission timeout of the oldest unacknowledged segment
+	if len(pcb.retxQueue) > 0 {
+		entry := &pcb.retxQueue[0]
+		earlier(entry.first.Add(pcb.timeout))
+		if !pcb.zeroWindow() {
+			earlier(entry.last.Add(pcb.retxTimeout(entry)))
+		}
+	}
+	if pcb.ackPending > 0 {
+		earlier(pcb.ackDue)
+	}
+
+	now := time.Now()
+	if pcb.zeroWindow() && (len(pcb.txQueue) > 0 || len(pcb.retxQueue) > 0) {
+		if pcb.persistNext.IsZero() {
+			earlier(now) // persist starts the timer
+		} else {
+			earlier(pcb.persistNext)
+		}
+	}
+	if pcb.keepAlive.Enable && len(pcb.retxQueue) == 0 && len(pcb.txQueue) == 0 &&
+		(pcb.state == PCBStateEstablished || pcb.state == PCBStateCloseWait) {
+		switch {
+		case pcb.lastRxTime.IsZero():
+			earlier(now) // keepalive starts the timer
+		case pcb.keepProbes == 0:
+			earlier(pcb.lastRxTime.Add(pcb.keepAlive.Idle))
 		default:
+			earlier(pcb.keepNext)
 		}
+	}
 
-		time.Sleep(time.Second)
-		mutex.Lock()
+	// nothing is outstanding but the data could not be sent
+	if (len(pcb.txQueue) > 0 || pcb.finQueued) && pcb.snd.wnd > 0 && pcb.snd.nxt == pcb.snd.una {
+		earlier(now.Add(outputRetryInterval))
+	}
+	return due, !due.IsZero()
+}
 
-		for _, pcb := range pcbs {
+// rearm schedules the timer of the pcb at its next timeout. The timer may expire earlier
+// than the timeout (e.g. the segment is acknowledged), then onTimer arms it again.
+// mutex must be held by the caller.
+func (pcb *pcb) rearm() {
+	if pcb.proto == nil {
+		return
+	}
+	due, ok := pcb.nextTimeout()
+	if !ok {
+		pcb.proto.wheel.remove(&pcb.timer)
+		return
+	}
+	if pcb.timer.f == nil {
+		pcb.timer.f = pcb.onTimer
+	}
+	pcb.proto.wheel.schedule(&pcb.timer, due)
+}
+
+// onTimer handles the timeouts of the pcb which have expired. mutex must be held by the caller.
+func (pcb *pcb) onTimer() {
+	now := time.Now()
+
+	// time-wait timeout
+	if pcb.state == PCBStateTimeWait {
+		if !now.Before(pcb.lastTxTime.Add(MSL)) {
+			pcb.signalErr("connection aborted due to user timeout")
+			pcb.transition(PCBStateClosed)
+			return
+		}
+		pcb.rearm()
+		return
+	}
 
-			// time-wait timeout
-			if pcb.state == PCBStateTimeWait && pcb.lastTxTime.Add(MSL).Before(time.Now()) {
-				pcb.signalErr("connection aborted due to user timeout")
+	// FIN-WAIT-2 timeout of the orphaned connection
+	if pcb.release && pcb.state == PCBStateFINWait2 && !now.Before(pcb.finWait2Time.Add(pcb.proto.finTimeout)) {
+		log.Printf("[I] TCP FIN-WAIT-2 timeout local=%s,foreign=%s", pcb.local, pcb.foreign)
+		if err := pcb.abort(); err != nil {
+			log.Printf("[E] TCP abort error %s", err.Error())
+		}
+		return
+	}
+
+	pcb.queueAck()
+	if len(pcb.retxQueue) > 0 {
+		// the retransmission timer is for the oldest unacknowledged segment
+		entry := &pcb.retxQueue[0]
+
+		// user timeout
+		if !now.Before(entry.first.Add(pcb.timeout)) {
+			pcb.signalErr("connection aborted due to user timeout")
+			pcb.transition(PCBStateClosed)
+			return
+		}
+
+		// retransmission, the persist timer probes the window instead while it is closed
+		// so that the foreign which does not read is not regarded as dead
+		if !pcb.zeroWindow() && !now.Before(entry.last.Add(pcb.retxTimeout(entry))) {
+			if entry.retxCount >= maxRetxCount { // retransmission time is over than limit
+				pcb.signalErr("retransmission time is over than limit,network may be not connected")
 				pcb.transition(PCBStateClosed)
-				continue
+				return
 			}
 
-			pcb.queueAck()
-			var deleteIndex []int
-			for i, entry := range pcb.retxQueue {
-
-				// user timeout
-				if entry.first.Add(pcb.timeout).Before(time.Now()) {
-					pcb.signalErr("connection aborted due to user timeout")
-					pcb.transition(PCBStateClosed)
-					break
-				}
-
-				// retransmission
-				rtoNow := rto * (1 << entry.retxCount)
-				if entry.last.Add(rtoNow).Before(time.Now()) {
-					entry.retxCount++
-
-					if entry.retxCount >= maxRetxCount { // retransmission time is over than limit
-						// notify user
-						if entry.errCh != nil {
-							entry.errCh <- fmt.Errorf("retransmission time is over than limit,network may be not connected")
-						}
-						deleteIndex = append(deleteIndex, i)
-					} else { // retransmission
-						log.Printf("[I] restransmission time=%d,local=%s,foreign=%s,seq=%d,flag=%s", entry.retxCount, pcb.local, pcb.foreign, entry.seq, entry.flag)
-						err := TxHandler(pcb.local, pcb.foreign, entry.data, entry.seq, pcb.rcv.nxt, entry.flag, pcb.snd.wnd, 0)
-						if err != nil {
-							log.Printf("[E] : retransmit error %s", err)
-						}
-						entry.last = time.Now()
-					}
-				}
+			// the loss is detected by the timeout, fast recovery is given up
+			pcb.cc.OnTimeout(pcb.snd.nxt - pcb.snd.una)
+			pcb.inRecovery = false
+			pcb.dupAcks = 0
+			pcb.recover = pcb.snd.nxt
+
+			// the window collapses to one segment, all of the segments not SACKed are retransmitted
+			// after the oldest one as the window grows (go-back-N, RFC5681 3.1)
+			pcb.lossRecovery = true
+			pcb.highRxt = pcb.snd.una
+
+			entry.retxCount++
+			log.Printf("[I] restransmission time=%d,local=%s,foreign=%s,seq=%d,flag=%s,rto=%s", entry.retxCount, pcb.local, pcb.foreign, entry.seq, entry.flag, pcb.retxTimeout(entry))
+			pcb.retransmit()
+		}
+	}
+
+	// delayed ACK, unless it has been already sent with the other segment
+	if pcb.ackPending > 0 && !now.Before(pcb.ackDue) {
+		if err := TxHelperTCP(pcb, ACK, []byte{}, 0, nil); err != nil {
+			log.Printf("[E] TCP delayed ACK error %s", err.Error())
+		}
+	}
+
+	if pcb.keepalive() {
+		return
+	}
+
+	// the queued data which could not be sent
+	pcb.persist()
+	if err := pcb.output(); err != nil {
+		log.Printf("[E] TCP output error %s", err.Error())
+	}
+	pcb.rearm()
+}
+
+// timer advances the timer wheel and calls the timers which expire,
+// it sleeps until the wheel has something to do or the earlier timer is added.
+func (p *Proto) timer(done chan struct{}) {
+	sleep := time.NewTimer(0)
+
+	for {
+		p.mutex.Lock()
+		for _, t := range p.wheel.advance(time.Now()) {
+			t.f()
+		}
+		at, ok := p.wheel.next()
+		p.mutex.Unlock()
+
+		if !sleep.Stop() {
+			select {
+			case <-sleep.C:
+			default:
 			}
-			pcb.retxQueue = removeRetx(pcb.retxQueue, deleteIndex)
+		}
+		if ok {
+			sleep.Reset(time.Until(at))
 		}
 
-		mutex.Unlock()
+		select {
+		case <-done:
+			sleep.Stop()
+			return
+		case <-p.wheel.wake:
+		case <-sleep.C:
+		}
 	}
 }
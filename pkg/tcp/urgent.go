@@ -0,0 +1,129 @@
+package tcp
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+)
+
+/*
+	Urgent data (RFC793, RFC6093)
+*/
+
+// urgentPointer returns the flag and the urgent pointer of the segment starting at seq,
+// URG is set while the segment is before SND.UP. The urgent pointer points to the octet
+// following the urgent data (RFC6093) and is 0xffff if it is too far from seq.
+func (pcb *pcb) urgentPointer(seq uint32, flag ControlFlag) (ControlFlag, uint16) {
+	if !pcb.sndUrgent || isSet(flag, SYN) || !seqLT(seq, pcb.snd.up) {
+		return flag, 0
+	}
+	up := pcb.snd.up - seq
+	if up > math.MaxUint16 {
+		up = math.MaxUint16
+	}
+	return flag | URG, uint16(up)
+}
+
+// receiveUrgent updates RCV.UP with the urgent pointer of the segment. The user is signaled
+// only if the urgent data has not been delivered, and not again for the same urgent data.
+func (pcb *pcb) receiveUrgent(seg segment) {
+	if seg.up == 0 { // the pointer to the first octet means no urgent data
+		return
+	}
+	up := seg.seq + uint32(seg.up)
+	if !seqLT(pcb.rcv.nxt, up) || (pcb.rcvUrgent && !seqLT(pcb.rcv.up, up)) {
+		return
+	}
+	pcb.rcv.up = up
+	pcb.rcvUrgent = true
+	log.Printf("[D] TCP urgent data is signaled local=%s,rcv.up=%d", pcb.local, up)
+	pcb.notify()
+}
+
+// deliverUrgent puts data whose octet at off is the last one of the urgent data into the receive queue
+// and sets the urgent mark there. The octet is taken out of the stream unless oobInline.
+func (pcb *pcb) deliverUrgent(data []byte, off int) {
+	pcb.rcvUrgent = false
+	pcb.urgMark = pcb.rxBuf.Len() + off
+	pcb.urgMarkSet = true
+	if pcb.oobInline {
+		pcb.rxBuf.write(data)
+		pcb.rcv.wnd -= uint32(len(data))
+	} else {
+		pcb.oob = data[off]
+		pcb.oobValid = true
+		pcb.rxBuf.write(data[:off])
+		pcb.rxBuf.write(data[off+1:])
+		pcb.rcv.wnd -= uint32(len(data) - 1)
+	}
+	pcb.rcv.nxt += uint32(len(data))
+	pcb.notify()
+}
+
+// WriteUrgent copies the data into the send buffer as the urgent data,
+// the urgent pointer points to the octet following the data. It blocks like Write.
+func (pcb *pcb) WriteUrgent(data []byte, deadline <-chan struct{}) (int, error) {
+	return pcb.writeWait(data, true, deadline)
+}
+
+// ReadUrgent reads the last octet of the urgent data, which is taken out of the stream (out-of-band).
+// It blocks until the urgent data arrives, the foreign closes the connection (io.EOF) or deadline is closed.
+func (pcb *pcb) ReadUrgent(buf []byte, deadline <-chan struct{}) (int, error) {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+
+	for {
+		if pcb.oobInline {
+			return 0, fmt.Errorf("urgent data is received inline")
+		}
+		if pcb.oobValid {
+			if len(buf) == 0 {
+				return 0, nil
+			}
+			buf[0] = pcb.oob
+			pcb.oobValid = false
+			return 1, nil
+		}
+
+		switch pcb.state {
+		case PCBStateListen, PCBStateSYNSent, PCBStateSYNReceived:
+			return 0, fmt.Errorf("connection does not exist")
+		case PCBStateClosed:
+			if pcb.err != nil {
+				return 0, pcb.err
+			}
+			return 0, fmt.Errorf("connection does not exist")
+		}
+		if pcb.finReceived || pcb.readShut {
+			return 0, io.EOF
+		}
+
+		event := pcb.wait()
+		pcb.proto.mutex.Unlock()
+		select {
+		case <-event:
+			pcb.proto.mutex.Lock()
+		case <-deadline:
+			pcb.proto.mutex.Lock()
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// SetOOBInline leaves the urgent data in the stream if inline is true,
+// otherwise the last octet of it is read by ReadUrgent (default).
+func (pcb *pcb) SetOOBInline(inline bool) {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	pcb.oobInline = inline
+}
+
+// AtMark reports whether the data read next follows the urgent mark,
+// the data before the mark can be discarded when the urgent data is signaled.
+func (pcb *pcb) AtMark() bool {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	return pcb.urgMarkSet && pcb.urgMark == 0
+}
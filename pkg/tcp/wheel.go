@@ -0,0 +1,223 @@
+package tcp
+
+import (
+	"time"
+)
+
+/*
+	Hierarchical timer wheel
+*/
+
+const (
+	// each level of the wheel has wheelSize slots and one slot covers the whole lower level,
+	// so the wheel holds the timers within wheelSpan ticks (about 4.6 hours)
+	wheelBits   = 6
+	wheelSize   = 1 << wheelBits
+	wheelMask   = wheelSize - 1
+	wheelLevels = 4
+	wheelSpan   = 1 << (wheelBits * wheelLevels)
+)
+
+// wheelTimer is the timer in the timer wheel, which is linked in the list of the slot
+type wheelTimer struct {
+	expire uint64
+	f      func()
+
+	prev *wheelTimer
+	next *wheelTimer
+}
+
+// pending reports whether the timer is in the wheel
+func (t *wheelTimer) pending() bool {
+	return t.next != nil
+}
+
+// timerWheel is the hierarchical timer wheel whose tick is timerInterval.
+// Adding and removing the timer take O(1), the timers in the upper level are moved
+// to the lower levels when the lower level wraps around.
+// The owner sleeps until the time next returns, the wheel is advanced only when it has something to do.
+// It is not safe for concurrent use, the protocol calls it holding its mutex.
+type timerWheel struct {
+	start time.Time
+
+	// the tick processed next and the number of the timers in the wheel
+	now   uint64
+	count int
+
+	// the tick until which the owner sleeps, which next returned last
+	due uint64
+
+	// the sentinels of the lists of the timers
+	slots [wheelLevels][wheelSize]wheelTimer
+
+	// notified when the timer is added to the empty wheel or expires before due
+	wake chan struct{}
+}
+
+func (w *timerWheel) init() {
+	if !w.start.IsZero() {
+		return
+	}
+	w.start = time.Now()
+	for l := range w.slots {
+		for i := range w.slots[l] {
+			head := &w.slots[l][i]
+			head.prev = head
+			head.next = head
+		}
+	}
+}
+
+// tick returns the tick at t, which is rounded up if ceil is true
+func (w *timerWheel) tick(t time.Time, ceil bool) uint64 {
+	d := t.Sub(w.start)
+	if d <= 0 {
+		return 0
+	}
+	n := uint64(d / timerInterval)
+	if ceil && d%timerInterval != 0 {
+		n++
+	}
+	return n
+}
+
+// schedule makes t call its function at due or later,
+// t is left as it is if it already expires before due.
+func (w *timerWheel) schedule(t *wheelTimer, due time.Time) {
+	w.init()
+	if t.pending() && t.expire <= w.tick(due, true) {
+		return
+	}
+	w.remove(t)
+	w.add(t, due)
+}
+
+// add puts t into the wheel, which expires at due. The timer too far is put at the end of the wheel
+// and expires early, then the owner is expected to schedule it again.
+func (w *timerWheel) add(t *wheelTimer, due time.Time) {
+	w.init()
+	empty := w.count == 0
+	if empty {
+		// no timer needs the ticks passed while the wheel is empty
+		w.now = w.tick(time.Now(), false)
+	}
+
+	expire := w.tick(due, true)
+	if expire < w.now {
+		expire = w.now
+	}
+	if expire-w.now >= wheelSpan {
+		expire = w.now + wheelSpan - 1
+	}
+	t.expire = expire
+	w.link(t)
+	w.count++
+
+	if empty || expire < w.due {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// link puts t into the slot of the lowest level which covers its expiration
+func (w *timerWheel) link(t *wheelTimer) {
+	delta := t.expire - w.now
+	level := 0
+	for level < wheelLevels-1 && delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	head := &w.slots[level][(t.expire>>(wheelBits*level))&wheelMask]
+	t.prev = head.prev
+	t.next = head
+	head.prev.next = t
+	head.prev = t
+}
+
+// remove cancels t if it is in the wheel
+func (w *timerWheel) remove(t *wheelTimer) {
+	if !t.pending() {
+		return
+	}
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev = nil
+	t.next = nil
+	w.count--
+}
+
+// next returns the time when the wheel has to be advanced next, ok is false if the wheel is empty.
+func (w *timerWheel) next() (at time.Time, ok bool) {
+	w.init()
+	if w.count == 0 {
+		return time.Time{}, false
+	}
+	w.due = w.nextTick()
+	return w.start.Add(time.Duration(w.due) * timerInterval), true
+}
+
+// nextTick returns the first tick from now which has something to do, that is the non-empty slot
+// of the lowest level or the boundary where the non-empty slot of an upper level is moved to the lower levels.
+// The wheel must not be empty.
+func (w *timerWheel) nextTick() uint64 {
+
+	// the slot of each level is checked at the ticks when advance processes it
+	next := w.now + wheelSpan
+	for level := 0; level < wheelLevels; level++ {
+		shift := uint(wheelBits * level)
+		first := (w.now + 1<<shift - 1) >> shift << shift
+		for i := uint64(0); i < wheelSize; i++ {
+			tick := first + i<<shift
+			if tick >= next {
+				break
+			}
+			head := &w.slots[level][(tick>>shift)&wheelMask]
+			if head.next != head {
+				next = tick
+				break
+			}
+		}
+	}
+	return next
+}
+
+// advance moves the wheel to now and returns the timers which expire, they are removed from the wheel.
+func (w *timerWheel) advance(now time.Time) []*wheelTimer {
+	w.init()
+	var expired []*wheelTimer
+	end := w.tick(now, false)
+	for ; w.count > 0; w.now++ {
+
+		// the ticks which have nothing to do are skipped
+		next := w.nextTick()
+		if next > end {
+			if w.now <= end {
+				w.now = end + 1
+			}
+			break
+		}
+		w.now = next
+
+		// the timers of the upper level are moved to the lower levels when the lower level wraps around
+		for level := 1; level < wheelLevels && w.now&(1<<(wheelBits*level)-1) == 0; level++ {
+			head := &w.slots[level][(w.now>>(wheelBits*level))&wheelMask]
+			t := head.next
+			head.prev = head
+			head.next = head
+			for t != head {
+				next := t.next
+				w.link(t)
+				t = next
+			}
+		}
+
+		head := &w.slots[0][w.now&wheelMask]
+		for head.next != head {
+			t := head.next
+			w.remove(t)
+			expired = append(expired, t)
+		}
+	}
+	return expired
+}
@@ -6,11 +6,12 @@ import (
 	"strings"
 
 	"github.com/hedwig100/go-network/pkg/ip"
+	"github.com/hedwig100/go-network/pkg/port"
 )
 
 const (
-	PortMin uint16 = 49152
-	PortMax uint16 = 65535
+	PortMin uint16 = port.Min
+	PortMax uint16 = port.Max
 )
 
 // Endpoint is IP address and port number combination
@@ -3,7 +3,6 @@ package udp
 import (
 	"fmt"
 	"log"
-	"sync"
 
 	"github.com/hedwig100/go-network/pkg/ip"
 )
@@ -20,11 +19,6 @@ const (
 	pcbBufSize = 100
 )
 
-var (
-	mutex sync.Mutex
-	pcbs  []*pcb
-)
-
 // pcb is protocol control block for UDP
 type pcb struct {
 
@@ -36,6 +30,9 @@ type pcb struct {
 
 	// receive queue
 	rxQueue chan buffer
+
+	// protocol to which the pcb belongs
+	proto *Proto
 }
 
 // buffer is
@@ -48,35 +45,55 @@ type buffer struct {
 	data []byte
 }
 
-func pcbSelect(address ip.Addr, port uint16) *pcb {
-	for _, p := range pcbs {
-		if p.local.Addr == address && p.local.Port == port {
-			return p
-		}
+// pcbSelect returns the pcb to which the datagram to address:port is delivered,
+// the pcb bound to the address has priority over the one bound to the wildcard address.
+// mutex must be held by the caller.
+func (proto *Proto) pcbSelect(address ip.Addr, port uint16) *pcb {
+	if p, ok := proto.bound[Endpoint{Addr: address, Port: port}]; ok {
+		return p
+	}
+	if p, ok := proto.bound[Endpoint{Addr: ip.AddrAny, Port: port}]; ok {
+		return p
 	}
 	return nil
 }
 
-func Open() *pcb {
+// portUsed reports whether the port is bound with address,
+// every address is checked if address is the wildcard one.
+// mutex must be held by the caller.
+func (proto *Proto) portUsed(address ip.Addr, port uint16) bool {
+	if address != ip.AddrAny {
+		return proto.pcbSelect(address, port) != nil
+	}
+	for local := range proto.bound {
+		if local.Port == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (proto *Proto) Open() *pcb {
 	pcb := &pcb{
 		state: pcbStateOpen,
 		local: Endpoint{
 			Addr: ip.AddrAny,
 		},
 		rxQueue: make(chan buffer, pcbBufSize),
+		proto:   proto,
 	}
-	mutex.Lock()
-	pcbs = append(pcbs, pcb)
-	mutex.Unlock()
+	proto.mutex.Lock()
+	proto.pcbs = append(proto.pcbs, pcb)
+	proto.mutex.Unlock()
 	return pcb
 }
 
-func Close(pcb *pcb) error {
+func (proto *Proto) Close(pcb *pcb) error {
 
 	index := -1
-	mutex.Lock()
-	defer mutex.Unlock()
-	for i, p := range pcbs {
+	proto.mutex.Lock()
+	defer proto.mutex.Unlock()
+	for i, p := range proto.pcbs {
 		if p == pcb {
 			index = i
 			break
@@ -86,51 +103,71 @@ func Close(pcb *pcb) error {
 		return fmt.Errorf("pcb not found")
 	}
 
-	pcbs = append(pcbs[:index], pcbs[index+1:]...)
+	proto.pcbs = append(proto.pcbs[:index], proto.pcbs[index+1:]...)
+	if proto.bound[pcb.local] == pcb {
+		delete(proto.bound, pcb.local)
+	}
 	return nil
 }
 
 func (pcb *pcb) Bind(local Endpoint) error {
 
 	// check if the same address has not been bound
-	mutex.Lock()
-	defer mutex.Unlock()
-	for _, p := range pcbs {
-		if p.local == local {
-			return fmt.Errorf("local address(%s) is already binded", local)
-		}
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
+	if _, ok := pcb.proto.bound[local]; ok {
+		return fmt.Errorf("local address(%s) is already binded", local)
+	}
+	if pcb.proto.bound[pcb.local] == pcb {
+		delete(pcb.proto.bound, pcb.local)
 	}
 	pcb.local = local
+	pcb.proto.bound[local] = pcb
 	log.Printf("[I] bound address local=%s", local)
 	return nil
 }
 
 func (pcb *pcb) Send(data []byte, dst Endpoint) error {
 
-	local := pcb.local
+	local, err := pcb.autobind(dst)
+	if err != nil {
+		return err
+	}
 
+	// the source address is the one of the interface to dst
 	if local.Addr == ip.AddrAny {
-		route, err := ip.LookupTable(dst.Addr)
+		route, err := pcb.proto.ip.LookupTable(dst.Addr)
 		if err != nil {
 			return err
 		}
 		local.Addr = route.Iface.Unicast
 	}
 
-	if local.Port == 0 { // zero value of Port (uint16)
-		for p := PortMin; p <= PortMax; p++ {
-			if pcbSelect(local.Addr, p) != nil {
-				local.Port = p
-				log.Printf("[D] registered UDP :address=%s,port=%d", local.Addr, local.Port)
-				break
-			}
-		}
-		if local.Port == 0 {
-			return fmt.Errorf("there is no port number to assign")
-		}
-	}
+	return pcb.proto.TxHandler(local, dst, data)
+}
+
+// autobind binds the pcb to the ephemeral port if the port has not been bound,
+// so that the pcb receives the reply. It returns the local endpoint of the pcb.
+func (pcb *pcb) autobind(dst Endpoint) (Endpoint, error) {
+	pcb.proto.mutex.Lock()
+	defer pcb.proto.mutex.Unlock()
 
-	return TxHandler(local, dst, data)
+	if pcb.local.Port != 0 { // zero value of Port (uint16)
+		return pcb.local, nil
+	}
+	port, err := pcb.proto.ports.Allocate(pcb.local.Addr, dst.Addr, dst.Port, func(port uint16) bool {
+		return pcb.proto.portUsed(pcb.local.Addr, port)
+	})
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if pcb.proto.bound[pcb.local] == pcb {
+		delete(pcb.proto.bound, pcb.local)
+	}
+	pcb.local.Port = port
+	pcb.proto.bound[pcb.local] = pcb
+	log.Printf("[D] registered UDP :address=%s,port=%d", pcb.local.Addr, pcb.local.Port)
+	return pcb.local, nil
 }
 
 // Listen listens data and write data to 'data'. if 'block' is false, there is no blocking I/O.
@@ -0,0 +1,44 @@
+package udp
+
+import (
+	"testing"
+
+	"github.com/hedwig100/go-network/pkg/port"
+)
+
+func TestAutobind(t *testing.T) {
+	ports, err := port.NewAllocator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto := &Proto{
+		bound: make(map[Endpoint]*pcb),
+		ports: ports,
+	}
+	local := Endpoint{Addr: 0xc0000202}
+	foreign := Endpoint{Addr: 0xc0000201, Port: 7}
+
+	// the pcb bound to port 0 is re-keyed by the ephemeral port
+	pcb := proto.Open()
+	if err := pcb.Bind(local); err != nil {
+		t.Fatal(err)
+	}
+	bound, err := pcb.autobind(foreign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := proto.bound[local]; ok {
+		t.Errorf("%s is still bound after autobind", local)
+	}
+	if proto.bound[bound] != pcb {
+		t.Errorf("%s is not bound after autobind", bound)
+	}
+
+	// the address can be bound again after the pcb is closed
+	if err := proto.Close(pcb); err != nil {
+		t.Fatal(err)
+	}
+	if err := proto.Open().Bind(local); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,18 +3,46 @@ package udp
 import (
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/hedwig100/go-network/pkg/ip"
+	"github.com/hedwig100/go-network/pkg/port"
 )
 
-// Init prepare the UDP protocol.
-func Init() error {
-	return ip.ProtoRegister(&Proto{})
+// Init prepare the UDP protocol and registers it to the IP protocol.
+func Init(ipProto *ip.IProto) (*Proto, error) {
+	ports, err := port.NewAllocator()
+	if err != nil {
+		return nil, err
+	}
+	p := &Proto{
+		bound: make(map[Endpoint]*pcb),
+		ports: ports,
+		ip:    ipProto,
+	}
+	err = ipProto.ProtoRegister(p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 // Proto is struct for UDP protocol handler.
 // This implements IPUpperProto interface.
-type Proto struct{}
+// Proto has the UDP protocol control blocks of the stack.
+type Proto struct {
+	mutex sync.Mutex
+	pcbs  []*pcb
+
+	// the pcbs keyed by the local endpoint to which they are bound
+	bound map[Endpoint]*pcb
+
+	// allocator of the ephemeral port
+	ports *port.Allocator
+
+	// IP protocol which transmits UDP datagram
+	ip *ip.IProto
+}
 
 func (p *Proto) Type() ip.ProtoType {
 	return ip.ProtoUDP
@@ -28,9 +56,9 @@ func (p *Proto) RxHandler(data []byte, src ip.Addr, dst ip.Addr, ipIface *ip.Ifa
 	log.Printf("[D] UDP rxHandler: src=%s:%d,dst=%s:%d,iface=%s,udp header=%s,payload=%v", src, hdr.Src, dst, hdr.Dst, ipIface.Family(), hdr, payload)
 
 	// search udp pcb whose address is dst
-	mutex.Lock()
-	defer mutex.Unlock()
-	pcb := pcbSelect(dst, hdr.Dst)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pcb := p.pcbSelect(dst, hdr.Dst)
 	if pcb == nil {
 		return fmt.Errorf("destination UDP protocol control block not found")
 	}
@@ -46,7 +74,7 @@ func (p *Proto) RxHandler(data []byte, src ip.Addr, dst ip.Addr, ipIface *ip.Ifa
 }
 
 // TxHandler transmits UDP datagram to the other host.
-func TxHandler(src Endpoint, dst Endpoint, data []byte) error {
+func (p *Proto) TxHandler(src Endpoint, dst Endpoint, data []byte) error {
 
 	if len(data)+HeaderSize > ip.PayloadSizeMax {
 		return fmt.Errorf("data size is too large for UDP payload")
@@ -64,5 +92,5 @@ func TxHandler(src Endpoint, dst Endpoint, data []byte) error {
 	}
 
 	log.Printf("[D] UDP TxHandler: src=%s,dst=%s,udp header=%s", src, dst, hdr)
-	return ip.TxHandler(ip.ProtoUDP, data, src.Addr, dst.Addr)
+	return p.ip.TxHandler(ip.ProtoUDP, data, src.Addr, dst.Addr)
 }
@@ -1,6 +1,7 @@
 package udp_test
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -43,8 +44,13 @@ func TestUDP(t *testing.T) {
 
 	var err error
 
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// devices
-	ether, err := device.EtherInit("tap0")
+	ether, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,20 +60,15 @@ func TestUDP(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(ether, iface0)
+	s.IP.IfaceRegister(ether, iface0)
 
 	// default gateway
-	err = ip.SetDefaultGateway(iface0, defaultGateway)
-	if err != nil {
-		t.Error(err)
-	}
-
-	err = pkg.NetInit(false)
+	err = s.IP.SetDefaultGateway(iface0, defaultGateway)
 	if err != nil {
 		t.Error(err)
 	}
 
-	pkg.NetRun()
+	s.Run()
 
 	var seq int
 	src, _ := udp.Str2Endpoint("192.0.2.2:80")
@@ -84,7 +85,7 @@ func TestUDP(t *testing.T) {
 			}
 
 			time.Sleep(time.Second)
-			err = udp.TxHandler(src, dst, []byte("hello"))
+			err = s.UDP.TxHandler(src, dst, []byte("hello"))
 			seq++
 			if seq > 1 && err != nil { // when seq=1(first time),we get cache not found error. this is not the error
 				t.Error(err)
@@ -92,7 +93,7 @@ func TestUDP(t *testing.T) {
 		}
 	}()
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
@@ -106,8 +107,13 @@ func TestSendUDP(t *testing.T) {
 
 	var err error
 
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// devices
-	ether, err := device.EtherInit("tap0")
+	ether, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -117,20 +123,15 @@ func TestSendUDP(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(ether, iface0)
+	s.IP.IfaceRegister(ether, iface0)
 
 	// default gateway
-	err = ip.SetDefaultGateway(iface0, defaultGateway)
-	if err != nil {
-		t.Error(err)
-	}
-
-	err = pkg.NetInit(false)
+	err = s.IP.SetDefaultGateway(iface0, defaultGateway)
 	if err != nil {
 		t.Error(err)
 	}
 
-	pkg.NetRun()
+	s.Run()
 
 	var seq int
 	src, _ := udp.Str2Endpoint("192.0.2.2:80")
@@ -147,7 +148,7 @@ func TestSendUDP(t *testing.T) {
 			}
 
 			time.Sleep(time.Second)
-			err = udp.TxHandler(src, dst, []byte("hello world!\n"))
+			err = s.UDP.TxHandler(src, dst, []byte("hello world!\n"))
 			seq++
 			if seq > 1 && err != nil { // when seq=1(first time),we get cache not found error. this is not the error
 				t.Error(err)
@@ -155,7 +156,7 @@ func TestSendUDP(t *testing.T) {
 		}
 	}()
 
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
@@ -168,8 +169,13 @@ func TestSocketUDP(t *testing.T) {
 
 	var err error
 
+	s, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// devices
-	ether, err := device.EtherInit("tap0")
+	ether, err := device.EtherInit(s.Net, "tap0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -179,26 +185,21 @@ func TestSocketUDP(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ip.IfaceRegister(ether, iface0)
+	s.IP.IfaceRegister(ether, iface0)
 
 	// default gateway
-	err = ip.SetDefaultGateway(iface0, defaultGateway)
+	err = s.IP.SetDefaultGateway(iface0, defaultGateway)
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = pkg.NetInit(false)
-	if err != nil {
-		t.Error(err)
-	}
-
-	pkg.NetRun()
+	s.Run()
 
 	// var seq int
 	src, _ := udp.Str2Endpoint("192.0.2.2:7")
 	// dst, _ := pkg.Str2UDPEndpoint("192.0.2.1:7")
 
-	sock := udp.Open()
+	sock := s.UDP.Open()
 	err = sock.Bind(src)
 	if err != nil {
 		t.Error(err)
@@ -232,13 +233,185 @@ func TestSocketUDP(t *testing.T) {
 		}
 	}()
 
-	err = udp.Close(sock)
+	err = s.UDP.Close(sock)
 	if err != nil {
 		t.Error(err)
 	}
-	err = pkg.NetShutdown()
+	err = s.Shutdown()
 	if err != nil {
 		t.Error(err)
 	}
 
 }
+
+// pipeStacks returns two stacks connected with the pipe device.
+// addresses of the stacks are etherTapIPAddr and defaultGateway.
+func pipeStacks(t *testing.T) (*pkg.Stack, *pkg.Stack) {
+	s0, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := pkg.NetInit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev0, dev1, err := device.PipeInit(s0.Net, "pipe0", s1.Net, "pipe1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iface0, err := ip.NewIface(etherTapIPAddr, etherTapNetmask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s0.IP.IfaceRegister(dev0, iface0); err != nil {
+		t.Fatal(err)
+	}
+
+	iface1, err := ip.NewIface(defaultGateway, etherTapNetmask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s1.IP.IfaceRegister(dev1, iface1); err != nil {
+		t.Fatal(err)
+	}
+
+	s0.Run()
+	s1.Run()
+	return s0, s1
+}
+
+/*
+
+go test -v ./pkg/udp -run TestUDPPipe
+
+two stacks connected with the pipe device exchange datagrams
+
+*/
+
+func TestUDPPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	src, _ := udp.Str2Endpoint("192.0.2.2:80")
+	dst, _ := udp.Str2Endpoint("192.0.2.1:7")
+
+	sock0 := s0.UDP.Open()
+	if err = sock0.Bind(src); err != nil {
+		t.Fatal(err)
+	}
+	sock1 := s1.UDP.Open()
+	if err = sock1.Bind(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// echo server
+	go func() {
+		for {
+			n, data, endpoint := sock1.Listen(true)
+			if n > 0 {
+				sock1.Send(data, endpoint)
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		msg := fmt.Sprintf("hello%d", i)
+
+		// the first datagram may be lost while ARP resolves the address
+		var n int
+		var data []byte
+		var endpoint udp.Endpoint
+		for retry := 0; retry < 10 && n == 0; retry++ {
+			err = sock0.Send([]byte(msg), dst)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			for wait := 0; wait < 100 && n == 0; wait++ {
+				time.Sleep(time.Millisecond)
+				n, data, endpoint = sock0.Listen(false)
+			}
+		}
+
+		if n == 0 {
+			t.Fatalf("echo not received: %v", err)
+		}
+		if string(data) != msg || endpoint != dst {
+			t.Errorf("received %s from %s, want %s from %s", data, endpoint, msg, dst)
+		}
+	}
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUDPWildcardPipe(t *testing.T) {
+	var err error
+
+	s0, s1 := pipeStacks(t)
+
+	// the server is bound to every address, the client is not bound
+	wildcard, _ := udp.Str2Endpoint("0.0.0.0:7")
+	dst, _ := udp.Str2Endpoint("192.0.2.1:7")
+
+	sock0 := s0.UDP.Open()
+	sock1 := s1.UDP.Open()
+	if err = sock1.Bind(wildcard); err != nil {
+		t.Fatal(err)
+	}
+
+	// echo server
+	go func() {
+		for {
+			n, data, endpoint := sock1.Listen(true)
+			if n > 0 {
+				sock1.Send(data, endpoint)
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		msg := fmt.Sprintf("hello%d", i)
+
+		// the first datagram may be lost while ARP resolves the address
+		var n int
+		var data []byte
+		var endpoint udp.Endpoint
+		for retry := 0; retry < 10 && n == 0; retry++ {
+			err = sock0.Send([]byte(msg), dst)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			for wait := 0; wait < 100 && n == 0; wait++ {
+				time.Sleep(time.Millisecond)
+				n, data, endpoint = sock0.Listen(false)
+			}
+		}
+
+		if n == 0 {
+			t.Fatalf("echo not received: %v", err)
+		}
+		if string(data) != msg || endpoint != dst {
+			t.Errorf("received %s from %s, want %s from %s", data, endpoint, msg, dst)
+		}
+	}
+
+	err = s0.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+	err = s1.Shutdown()
+	if err != nil {
+		t.Error(err)
+	}
+}
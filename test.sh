@@ -25,6 +25,9 @@ check
 go test -v ./pkg/device/ -run TestLoopback
 check
 
+go test -v ./pkg/device/ -run TestPipe
+check
+
 # ip
 go test -v ./pkg/ip/ -run Test2
 check 
@@ -40,17 +43,92 @@ check
 go test -v ./pkg/icmp/ -run Test2
 check
 
+go test -v ./pkg/icmp/ -run TestICMPPipe
+check
+
 # udp 
 go test -v ./pkg/udp/ -run Test2
 check
 
+go test -v ./pkg/udp/ -run TestUDPPipe
+check
+
+go test -v ./pkg/udp/ -run TestUDPWildcardPipe
+check
+
 # tcp
 go test -v ./pkg/tcp/ -run Test2
 check
 
+go test -v ./pkg/tcp/ -run TestTCPPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPConnPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPAcceptPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPListenerPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPSegmentPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPZeroWindowPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPZeroWindowProbePipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPKeepAlivePipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPKeepAliveOffPathPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPStreamPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPWildcardPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPRefusedPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPSYNCookiePipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPSYNCookieAcceptQueuePipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPHalfClosePipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPLingerPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPUrgentPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPInfoPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPDialCancelPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPSimultaneousClosePipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPRTORecoveryPipe
+check
+
+go test -v ./pkg/tcp/ -run TestTCPFinWait2TimeoutPipe
+check
+
 # utils
 go test -v ./pkg/utils/
 check 
 
-# test icmp,udp,tcp in manually for now 
-# TODO: how to test icmp,udp,tcp automatically
+# tests with tap device (TestICMP,TestUDP,TestTCP...) are done manually,
+# icmp,udp,tcp are tested automatically with the pipe device above